@@ -0,0 +1,243 @@
+package grouter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type AccessLogFormat int
+
+const (
+	// CommonLogFormat is the Apache Common Log Format
+	CommonLogFormat AccessLogFormat = iota
+	// CombinedLogFormat is the Common Log Format followed by the referer and user agent
+	CombinedLogFormat
+	// JSONLogFormat writes one JSON object per request, including the matched route and duration
+	JSONLogFormat
+)
+
+const commonLogTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogger writes one line per request served, after every handler has run.
+type AccessLogger struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	format AccessLogFormat
+}
+
+type accessLogEntry struct {
+	Time          time.Time `json:"time"`
+	RemoteAddress string    `json:"remote_address"`
+	User          string    `json:"user,omitempty"`
+	Method        string    `json:"method"`
+	Route         string    `json:"route,omitempty"`
+	Path          string    `json:"path"`
+	Query         string    `json:"query,omitempty"`
+	Protocol      string    `json:"protocol"`
+	Status        int       `json:"status"`
+	Bytes         int       `json:"bytes"`
+	DurationMS    float64   `json:"duration_ms"`
+	Referer       string    `json:"referer,omitempty"`
+	UserAgent     string    `json:"user_agent,omitempty"`
+}
+
+func NewAccessLogger(w io.Writer, format AccessLogFormat) *AccessLogger {
+	return &AccessLogger{
+		writer: w,
+		format: format,
+	}
+}
+
+// UseAccessLogger logs every request the server handles, including unmatched ones and redirects, to logger.
+func (instance *Server) UseAccessLogger(logger *AccessLogger) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.accessLogger = logger
+}
+
+func (logger *AccessLogger) log(start time.Time, route string, r *http.Request, w *ResponseWriter, duration time.Duration) error {
+	entry := accessLogEntry{
+		Time:       start,
+		Method:     r.Method,
+		Route:      route,
+		Path:       r.URL.Path,
+		Query:      r.URL.RawQuery,
+		Protocol:   r.Proto,
+		Bytes:      w.BytesWritten,
+		DurationMS: float64(duration) / float64(time.Millisecond),
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+	}
+	entry.RemoteAddress, _ = splitHostPort(r.RemoteAddr)
+	if user, _, ok := r.BasicAuth(); ok {
+		entry.User = user
+	}
+	if w.StatusCode != nil {
+		entry.Status = *w.StatusCode
+	}
+
+	var line bytes.Buffer
+	switch logger.format {
+	case JSONLogFormat:
+		if err := json.NewEncoder(&line).Encode(entry); err != nil {
+			return err
+		}
+	case CombinedLogFormat:
+		writeCommonLogLine(&line, entry)
+		fmt.Fprintf(&line, " %s %s\n", quoteOrDash(entry.Referer), quoteOrDash(entry.UserAgent))
+	default:
+		writeCommonLogLine(&line, entry)
+		line.WriteByte('\n')
+	}
+
+	// Lines from concurrent requests must not interleave
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	_, err := logger.writer.Write(line.Bytes())
+	return err
+}
+
+func writeCommonLogLine(line *bytes.Buffer, entry accessLogEntry) {
+	requestLine := entry.Method + " " + entry.Path
+	if entry.Query != "" {
+		requestLine += "?" + entry.Query
+	}
+	requestLine += " " + entry.Protocol
+	fmt.Fprintf(line, "%s - %s [%s] %s %d %s",
+		orDash(entry.RemoteAddress),
+		orDash(entry.User),
+		entry.Time.Format(commonLogTimeLayout),
+		strconv.Quote(requestLine),
+		entry.Status,
+		bytesOrDash(entry.Bytes),
+	)
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func quoteOrDash(value string) string {
+	if value == "" {
+		return `"-"`
+	}
+	return strconv.Quote(value)
+}
+
+func bytesOrDash(n int) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.Itoa(n)
+}
+
+// RotatingFile is an io.WriteCloser for access logs that rotates the file once it grows past a size limit.
+// The file at path is renamed to path.1, older backups shift to path.2 and so on.
+type RotatingFile struct {
+	mutex      sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewRotatingFile opens path for appending. A maxBytes of 0 disables size based rotation.
+func NewRotatingFile(path string, maxBytes int64, maxBackups int) (*RotatingFile, error) {
+	rotating := &RotatingFile{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxBackups: maxBackups,
+	}
+	if err := rotating.open(); err != nil {
+		return nil, err
+	}
+	return rotating, nil
+}
+
+func (rotating *RotatingFile) Write(p []byte) (int, error) {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+
+	if rotating.maxBytes > 0 && rotating.size > 0 && rotating.size+int64(len(p)) > rotating.maxBytes {
+		if err := rotating.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rotating.file.Write(p)
+	rotating.size += int64(n)
+	return n, err
+}
+
+// Rotate starts a new file immediately, e.g. when asked to by an external log rotation tool.
+func (rotating *RotatingFile) Rotate() error {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+	return rotating.rotate()
+}
+
+func (rotating *RotatingFile) Close() error {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+	return rotating.file.Close()
+}
+
+func (rotating *RotatingFile) open() error {
+	file, size, err := openAppending(rotating.path)
+	if err != nil {
+		return err
+	}
+	rotating.file = file
+	rotating.size = size
+	return nil
+}
+
+func openAppending(path string) (*os.File, int64, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+// rotate moves the file aside before reopening path, so that the current file stays open if rotation fails.
+func (rotating *RotatingFile) rotate() error {
+	if rotating.maxBackups > 0 {
+		// Shift the existing backups up by one, the oldest is overwritten
+		for i := rotating.maxBackups - 1; i > 0; i-- {
+			from := fmt.Sprintf("%s.%d", rotating.path, i)
+			if _, err := os.Stat(from); err == nil {
+				if err := os.Rename(from, fmt.Sprintf("%s.%d", rotating.path, i+1)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := os.Rename(rotating.path, rotating.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rotating.path); err != nil {
+		return err
+	}
+	file, size, err := openAppending(rotating.path)
+	if err != nil {
+		return err
+	}
+	previous := rotating.file
+	rotating.file, rotating.size = file, size
+	return previous.Close()
+}
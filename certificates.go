@@ -0,0 +1,214 @@
+package grouter
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultCertificateReloadInterval = time.Minute
+
+// certificateStore serves the certificates of a TLSConfig through tls.Config.GetCertificate,
+// so that they can be reloaded or replaced without restarting the listeners.
+type certificateStore struct {
+	// Serializes reloads, handshakes read the certificates without locking
+	mutex        sync.Mutex
+	config       atomic.Pointer[TLSConfig]
+	certificates atomic.Pointer[certificateSet]
+	// handshake is the configuration of new connections, it carries the client CAs of config
+	handshake atomic.Pointer[tls.Config]
+	// The files as they were when they were last loaded, successfully or not
+	stamps []fileStamp
+}
+
+// certificateSet holds the loaded certificates of a TLSConfig, keyed by lower case server name or wildcard.
+type certificateSet struct {
+	byName map[string]*tls.Certificate
+	// fallback is served to clients that send no server name, or one that no certificate is for
+	fallback *tls.Certificate
+}
+
+// fileStamp identifies a version of a file without reading it.
+type fileStamp struct {
+	modified time.Time
+	size     int64
+}
+
+func stampFile(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modified: info.ModTime(), size: info.Size()}
+}
+
+func stampFiles(config *TLSConfig) []fileStamp {
+	stamps := []fileStamp{}
+	for _, pair := range config.pairs() {
+		stamps = append(stamps, stampFile(pair.CertFilePath), stampFile(pair.KeyFilePath))
+	}
+	if config.ClientCAFilePath != "" {
+		stamps = append(stamps, stampFile(config.ClientCAFilePath))
+	}
+	return stamps
+}
+
+// newCertificateStore loads the certificate and key files of config.
+func newCertificateStore(config *TLSConfig) (*certificateStore, error) {
+	store := &certificateStore{}
+	if err := store.replace(config); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// reload loads the files again, the current certificates are kept if they cannot be loaded.
+func (store *certificateStore) reload() error {
+	return store.replace(store.config.Load())
+}
+
+// replace serves the certificates of config from now on, the current ones are kept if any of config's files cannot be loaded.
+func (store *certificateStore) replace(config *TLSConfig) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	stamps := stampFiles(config)
+	set, err := loadCertificateSet(config)
+	var clientCAs *x509.CertPool
+	if err == nil {
+		clientCAs, err = loadClientCAs(config)
+	}
+	if err != nil {
+		// A broken reload is not retried until the files change again, a broken new config leaves the current one in place
+		if config == store.config.Load() {
+			store.stamps = stamps
+		}
+		return err
+	}
+	store.stamps = stamps
+	store.config.Store(config)
+	store.certificates.Store(set)
+	store.handshake.Store(&tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// GetConfigForClient replaces the protocols http.Server adds to its own TLS config
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: store.getCertificate,
+		ClientAuth:     clientAuthTypes[config.ClientAuth],
+		ClientCAs:      clientCAs,
+	})
+	return nil
+}
+
+func loadCertificateSet(config *TLSConfig) (*certificateSet, error) {
+	set := &certificateSet{byName: make(map[string]*tls.Certificate)}
+	pairs := config.pairs()
+	// The default pair is only the fallback, it does not take server names from the pairs after it
+	hasDefault := len(pairs) > len(config.Certificates)
+	for i, pair := range pairs {
+		certificate, err := tls.LoadX509KeyPair(pair.CertFilePath, pair.KeyFilePath)
+		if err != nil {
+			return nil, &TLSFileError{Path: pair.CertFilePath, Err: err}
+		}
+		if i == 0 {
+			set.fallback = &certificate
+			if hasDefault {
+				continue
+			}
+		}
+		names := pair.ServerNames
+		if len(names) == 0 {
+			leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+			if err != nil {
+				return nil, &TLSFileError{Path: pair.CertFilePath, Err: err}
+			}
+			certificate.Leaf = leaf
+			names = leaf.DNSNames
+		}
+		for _, name := range names {
+			// The first pair for a name wins, like the first route for a path
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if _, ok := set.byName[name]; !ok {
+				set.byName[name] = &certificate
+			}
+		}
+	}
+	return set, nil
+}
+
+// changed reports whether the files differ from when they were last loaded.
+func (store *certificateStore) changed() bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return !slices.Equal(stampFiles(store.config.Load()), store.stamps)
+}
+
+// reloadInterval returns how often watch checks the files, or zero when it does not.
+func (store *certificateStore) reloadInterval() time.Duration {
+	interval := store.config.Load().ReloadInterval
+	if interval == 0 {
+		return defaultCertificateReloadInterval
+	}
+	return max(interval, 0)
+}
+
+// watch reloads the files whenever they change until stop is closed.
+// A pair that cannot be loaded is logged once and retried when the files change again.
+func (store *certificateStore) watch(ctx context.Context, logger *slog.Logger, stop <-chan struct{}) {
+	for {
+		interval := store.reloadInterval()
+		if interval == 0 {
+			return
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if !store.changed() {
+			continue
+		}
+		if err := store.reload(); err != nil {
+			logger.ErrorContext(ctx, "changed TLS certificates cannot be loaded, keeping the current ones", "error", err)
+		} else {
+			logger.InfoContext(ctx, "reloaded changed TLS certificates", "cert_files", store.config.Load().certFiles())
+		}
+	}
+}
+
+// getCertificate selects the certificate for the server name the client sent (SNI).
+// An exact name is preferred over a wildcard for its first label, e.g. "*.example.com" for "api.example.com".
+func (store *certificateStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set := store.certificates.Load()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return set.fallback, nil
+	}
+	if certificate, ok := set.byName[name]; ok {
+		return certificate, nil
+	}
+	if _, parent, found := strings.Cut(name, "."); found {
+		if certificate, ok := set.byName["*."+parent]; ok {
+			return certificate, nil
+		}
+	}
+	return set.fallback, nil
+}
+
+// tlsConfig returns the crypto/tls configuration for the server's HTTPS endpoints,
+// every handshake uses the configuration current at that time.
+func (store *certificateStore) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return store.handshake.Load(), nil
+		},
+	}
+}
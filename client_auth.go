@@ -0,0 +1,163 @@
+package grouter
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+)
+
+// ClientAuthMode is how HTTPS endpoints ask clients for a certificate (mutual TLS).
+type ClientAuthMode int
+
+const (
+	// ClientAuthNone does not ask clients for a certificate
+	ClientAuthNone ClientAuthMode = iota
+	// ClientAuthRequest asks for a certificate but neither requires nor verifies it
+	ClientAuthRequest
+	// ClientAuthRequire refuses the handshake unless the client presents a certificate signed by a client CA
+	ClientAuthRequire
+	// ClientAuthVerifyIfGiven accepts clients without a certificate, and verifies the certificate of those that present one
+	ClientAuthVerifyIfGiven
+)
+
+var clientAuthTypes = map[ClientAuthMode]tls.ClientAuthType{
+	ClientAuthNone:          tls.NoClientCert,
+	ClientAuthRequest:       tls.RequestClientCert,
+	ClientAuthRequire:       tls.RequireAndVerifyClientCert,
+	ClientAuthVerifyIfGiven: tls.VerifyClientCertIfGiven,
+}
+
+func validateClientAuth(config *TLSConfig) error {
+	if _, ok := clientAuthTypes[config.ClientAuth]; !ok {
+		return &TLSFileError{Path: config.ClientCAFilePath, Err: fmt.Errorf("invalid client auth mode %d", config.ClientAuth)}
+	}
+	if config.ClientCAFilePath == "" {
+		if config.ClientAuth == ClientAuthRequire || config.ClientAuth == ClientAuthVerifyIfGiven {
+			return &TLSFileError{Err: errors.New("verifying client certificates requires a client CA file")}
+		}
+		return nil
+	}
+	if err := validatePath(config.ClientCAFilePath); err != nil {
+		return &TLSFileError{Path: config.ClientCAFilePath, Err: err}
+	}
+	return nil
+}
+
+// loadClientCAs returns the pool of config's client CA file, or nil when it has none.
+func loadClientCAs(config *TLSConfig) (*x509.CertPool, error) {
+	if config.ClientCAFilePath == "" {
+		return nil, nil
+	}
+	bundle, err := os.ReadFile(config.ClientCAFilePath)
+	if err != nil {
+		return nil, &TLSFileError{Path: config.ClientCAFilePath, Err: err}
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, &TLSFileError{Path: config.ClientCAFilePath, Err: errors.New("no PEM certificates in client CA file")}
+	}
+	return pool, nil
+}
+
+// ClientIdentity is the identity in the certificate a client presented over mutual TLS.
+type ClientIdentity struct {
+	Subject        pkix.Name
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	// SPIFFEID is the certificate's spiffe:// URI, or nil when it has none
+	SPIFFEID *url.URL
+	// Verified reports whether the certificate chains to a client CA, it does not with ClientAuthRequest
+	Verified    bool
+	Certificate *x509.Certificate
+}
+
+// ClientIdentityFromRequest returns the identity of the client certificate of r, if the client presented one.
+func ClientIdentityFromRequest(r *http.Request) (*ClientIdentity, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, false
+	}
+	certificate := r.TLS.PeerCertificates[0]
+	identity := &ClientIdentity{
+		Subject:        certificate.Subject,
+		DNSNames:       certificate.DNSNames,
+		EmailAddresses: certificate.EmailAddresses,
+		IPAddresses:    certificate.IPAddresses,
+		URIs:           certificate.URIs,
+		Verified:       len(r.TLS.VerifiedChains) > 0,
+		Certificate:    certificate,
+	}
+	for _, uri := range certificate.URIs {
+		if uri.Scheme == "spiffe" {
+			identity.SPIFFEID = uri
+			break
+		}
+	}
+	return identity, true
+}
+
+// ClientIdentityPolicy lists the client identities allowed on a route. A client is allowed when it matches any entry,
+// an empty policy allows every client with a verified certificate.
+type ClientIdentityPolicy struct {
+	// SPIFFEIDs are allowed SPIFFE IDs, e.g. "spiffe://mesh.internal/ns/payments/sa/api"
+	SPIFFEIDs []string
+	// TrustDomains allow every SPIFFE ID of a trust domain, e.g. "mesh.internal"
+	TrustDomains []string
+	// DNSNames are allowed DNS names of the certificate
+	DNSNames []string
+	// CommonNames are allowed subject common names
+	CommonNames []string
+}
+
+func (policy *ClientIdentityPolicy) allows(identity *ClientIdentity) bool {
+	if !identity.Verified {
+		return false
+	}
+	if len(policy.SPIFFEIDs) == 0 && len(policy.TrustDomains) == 0 && len(policy.DNSNames) == 0 && len(policy.CommonNames) == 0 {
+		return true
+	}
+	if identity.SPIFFEID != nil &&
+		(slices.Contains(policy.SPIFFEIDs, identity.SPIFFEID.String()) || slices.Contains(policy.TrustDomains, identity.SPIFFEID.Host)) {
+		return true
+	}
+	for _, name := range identity.DNSNames {
+		if slices.Contains(policy.DNSNames, name) {
+			return true
+		}
+	}
+	return slices.Contains(policy.CommonNames, identity.Subject.CommonName)
+}
+
+// RequireClientIdentity returns a route handler that answers 403 unless the client presented a verified certificate
+// allowed by policy. Register it before the handlers it protects, e.g. server.Use("/admin", GET, RequireClientIdentity(policy)).
+func RequireClientIdentity(policy ClientIdentityPolicy) RequestHandler {
+	return func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		identity, ok := ClientIdentityFromRequest(r)
+		if !ok || !policy.allows(identity) {
+			LoggerFromContext(ctx).WarnContext(ctx, "client identity not allowed", "path", r.URL.Path, "client", clientSubject(identity))
+			w.WriteHeader(http.StatusForbidden)
+			return nil
+		}
+		next()
+		return nil
+	}
+}
+
+func clientSubject(identity *ClientIdentity) string {
+	if identity == nil {
+		return ""
+	}
+	if identity.SPIFFEID != nil {
+		return identity.SPIFFEID.String()
+	}
+	return identity.Subject.String()
+}
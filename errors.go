@@ -0,0 +1,95 @@
+package grouter
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrAlreadyServing is returned when Listen is called on a server that is already serving
+	ErrAlreadyServing = errors.New("grouter: server is already serving")
+	// ErrNotServing is returned by methods that need a serving server, e.g. Restart
+	ErrNotServing = errors.New("grouter: server is not serving")
+	// ErrTLSNotConfigured is returned when ServeTLS is called on a server without a TLSConfig
+	ErrTLSNotConfigured = errors.New("grouter: TLS is not configured")
+	// ErrInvalidTLSFiles is matched by errors about unusable TLS certificate or key files
+	ErrInvalidTLSFiles = errors.New("grouter: invalid TLS files")
+	// ErrBadPattern is matched by errors about route paths and ignored path patterns that do not compile
+	ErrBadPattern = errors.New("grouter: bad path pattern")
+	// ErrDuplicateRoute is matched by errors about registering a route that already has handlers
+	ErrDuplicateRoute = errors.New("grouter: duplicate route")
+	// ErrShutdownTimeout is matched by errors about a Shutdown that had to close connections with requests in flight
+	ErrShutdownTimeout = errors.New("grouter: shutdown timed out")
+	// ErrSocketInUse is matched by errors about a Unix socket another server still accepts connections on
+	ErrSocketInUse = errors.New("grouter: socket is in use")
+)
+
+// TLSFileError reports a TLS certificate or key file that cannot be used.
+type TLSFileError struct {
+	Path string
+	Err  error
+}
+
+func (e *TLSFileError) Error() string {
+	return fmt.Sprintf("grouter: invalid TLS file: %v", e.Err)
+}
+
+func (e *TLSFileError) Unwrap() []error {
+	return []error{ErrInvalidTLSFiles, e.Err}
+}
+
+// PatternError reports a route path or ignored path pattern that does not compile.
+type PatternError struct {
+	Pattern string
+	Err     error
+}
+
+func (e *PatternError) Error() string {
+	return fmt.Sprintf("grouter: bad path pattern %q: %v", e.Pattern, e.Err)
+}
+
+func (e *PatternError) Unwrap() []error {
+	return []error{ErrBadPattern, e.Err}
+}
+
+// RouteError reports a route registration that conflicts with the existing routes.
+type RouteError struct {
+	Path   string
+	Method HTTPMethod
+	Err    error
+}
+
+func (e *RouteError) Error() string {
+	return fmt.Sprintf("grouter: route %s %s: %v", e.Method, e.Path, e.Err)
+}
+
+func (e *RouteError) Unwrap() error {
+	return e.Err
+}
+
+// SocketError reports a Unix socket path that cannot be listened on.
+type SocketError struct {
+	Path string
+	Err  error
+}
+
+func (e *SocketError) Error() string {
+	return fmt.Sprintf("grouter: socket %s: %v", e.Path, e.Err)
+}
+
+func (e *SocketError) Unwrap() error {
+	return e.Err
+}
+
+// ShutdownTimeoutError reports the requests that were cut off when Shutdown closed the remaining connections.
+type ShutdownTimeoutError struct {
+	Interrupted int64
+}
+
+func (e *ShutdownTimeoutError) Error() string {
+	return fmt.Sprintf("grouter: shutdown timed out, %d requests were interrupted", e.Interrupted)
+}
+
+func (e *ShutdownTimeoutError) Unwrap() error {
+	return ErrShutdownTimeout
+}
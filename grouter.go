@@ -3,12 +3,20 @@ package grouter
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"reflect"
 	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/dghubble/trie"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ProxyTarget struct {
@@ -37,15 +45,27 @@ const (
 
 type RequestHandler func(context.Context, *ResponseWriter, *http.Request, func()) error
 type Route map[HTTPMethod][]RequestHandler
+
+// routeHandler is a route handler with the name of its span.
+type routeHandler struct {
+	name    string
+	handler RequestHandler
+}
+
+// methodHandlers are the handler chains of a path in the route table.
+type methodHandlers map[HTTPMethod][]routeHandler
 type GlobalRouteOptions struct {
-	afterAll           bool
-	ignoredPathRegexes []string
+	// AfterAll runs the handler after the route handlers instead of before them
+	AfterAll bool
+	// IgnoredPathRegexes skip the handler for route templates they match
+	IgnoredPathRegexes []string
 }
 type concreteGlobalRouteOptions struct {
 	afterAll           bool
 	ignoredPathRegexes []regexp.Regexp
 }
 type GlobalHandler struct {
+	name    string
 	options *concreteGlobalRouteOptions
 	handler RequestHandler
 }
@@ -54,67 +74,315 @@ type internalGlobalHandlers struct {
 	afterAll  []GlobalHandler
 }
 
-type Router struct {
+// routeTable is an immutable snapshot of a Router's routes, every change replaces the whole table.
+type routeTable struct {
 	trie           *trie.PathTrie
 	paths          map[string]struct{}
 	globalHandlers internalGlobalHandlers
+	// mux matches request paths to route templates with net/http's pattern rules
+	mux *http.ServeMux
+}
+
+// routeMatch marks the route template a request matched in a routeTable's mux.
+type routeMatch string
+
+func (routeMatch) ServeHTTP(http.ResponseWriter, *http.Request) {}
+
+// Router is safe for concurrent use. Routes can be changed while a server is serving them,
+// requests that already started finish with the routes they started with.
+type Router struct {
+	// Serializes changes, requests read the table without locking
+	mutex          sync.Mutex
+	table          atomic.Pointer[routeTable]
 	context        context.Context
+	logger         *slog.Logger
+	tracerProvider trace.TracerProvider
 }
 
 func NewRouter(context context.Context) *Router {
-	return &Router{
+	router := &Router{
+		context:        context,
+		logger:         withTraceCorrelation(slog.Default()),
+		tracerProvider: otel.GetTracerProvider(),
+	}
+	table := &routeTable{
 		trie:  trie.NewPathTrie(),
 		paths: make(map[string]struct{}),
 		globalHandlers: internalGlobalHandlers{
 			beforeAll: []GlobalHandler{},
 			afterAll:  []GlobalHandler{},
 		},
-		context: context,
 	}
+	// An empty table has no patterns to reject
+	table.buildMux()
+	router.table.Store(table)
+	return router
+}
+
+// routes returns the current route table.
+func (instance *Router) routes() *routeTable {
+	return instance.table.Load()
+}
+
+// SetLogger replaces the logger used for the router's diagnostics.
+func (instance *Router) SetLogger(logger *slog.Logger) *Router {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.logger = withTraceCorrelation(logger)
+	return instance
 }
 
-func (instance *Router) UseGlobal(handler RequestHandler, options *GlobalRouteOptions) {
+func (instance *Router) setContext(ctx context.Context) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.context = ctx
+}
+
+func (instance *Router) setTracerProvider(provider trace.TracerProvider) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.tracerProvider = provider
+}
+
+// UseGlobal registers a handler that runs for every route, it fails with ErrBadPattern when an ignored path pattern does not compile.
+func (instance *Router) UseGlobal(handler RequestHandler, options *GlobalRouteOptions) error {
+	return instance.UseGlobalNamed(handlerName(handler), handler, options)
+}
+
+// UseGlobalNamed registers a global handler whose span is called name.
+func (instance *Router) UseGlobalNamed(name string, handler RequestHandler, options *GlobalRouteOptions) error {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+
 	// Tracing
 	var spanName string
-	if options != nil && options.afterAll {
+	if options != nil && options.AfterAll {
 		spanName = "UseGlobal:AfterAll"
 	} else {
 		spanName = "UseGlobal:BeforeAll"
 	}
-	_, span := otel.Tracer(traceProviderName).Start(instance.context, spanName)
+	_, span := instance.tracerProvider.Tracer(traceProviderName).Start(instance.context, spanName)
 	defer span.End()
 	// End tracing
 
-	concreteOptions := convertToConcreteGlobalRouteOptions(options)
-	if concreteOptions != nil && concreteOptions.afterAll {
-		instance.globalHandlers.afterAll = append(instance.globalHandlers.afterAll, GlobalHandler{
+	concreteOptions, err := convertToConcreteGlobalRouteOptions(options)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	table := instance.routes().clone()
+	if concreteOptions.afterAll {
+		table.globalHandlers.afterAll = append(table.globalHandlers.afterAll, GlobalHandler{
+			name:    name,
 			options: concreteOptions,
 			handler: handler,
 		})
 	} else {
-		instance.globalHandlers.beforeAll = append(instance.globalHandlers.beforeAll, GlobalHandler{
+		table.globalHandlers.beforeAll = append(table.globalHandlers.beforeAll, GlobalHandler{
+			name:    name,
 			options: concreteOptions,
 			handler: handler,
 		})
 	}
+	instance.table.Store(table)
+	return nil
 }
 
 func (instance *Router) Use(path string, method HTTPMethod, handler RequestHandler) {
+	instance.UseNamed(path, method, handlerName(handler), handler)
+}
+
+// UseNamed registers a route handler whose span is called name.
+func (instance *Router) UseNamed(path string, method HTTPMethod, name string, handler RequestHandler) {
+	instance.update(fmt.Sprintf("Use %s %s", method, path), func(table *routeTable) error {
+		table.setHandlers(path, method, append(table.route(path)[method], routeHandler{
+			name:    name,
+			handler: handler,
+		}))
+		return nil
+	})
+}
+
+// Handle registers handler as the only handler for path and method,
+// it fails with ErrDuplicateRoute when the method already has handlers.
+func (instance *Router) Handle(path string, method HTTPMethod, handler RequestHandler) error {
+	return instance.update(fmt.Sprintf("Handle %s %s", method, path), func(table *routeTable) error {
+		if len(table.route(path)[method]) > 0 {
+			return &RouteError{Path: path, Method: method, Err: ErrDuplicateRoute}
+		}
+		table.setHandlers(path, method, namedHandlers([]RequestHandler{handler}))
+		return nil
+	})
+}
+
+// Replace swaps the handler chain for path and method, registering it if there is none.
+// Replacing with no handlers is the same as Remove.
+func (instance *Router) Replace(path string, method HTTPMethod, handlers ...RequestHandler) {
+	instance.update(fmt.Sprintf("Replace %s %s", method, path), func(table *routeTable) error {
+		table.setHandlers(path, method, namedHandlers(handlers))
+		return nil
+	})
+}
+
+// Remove clears the handler chain for path and method and reports whether there was one.
+// The path is unregistered once none of its methods have handlers.
+func (instance *Router) Remove(path string, method HTTPMethod) bool {
+	removed := false
+	instance.update(fmt.Sprintf("Remove %s %s", method, path), func(table *routeTable) error {
+		removed = len(table.route(path)[method]) > 0
+		table.setHandlers(path, method, nil)
+		return nil
+	})
+	return removed
+}
+
+// update applies change to a copy of the route table and publishes the copy unless change fails.
+func (instance *Router) update(spanName string, change func(*routeTable) error) error {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+
 	// Tracing
-	_, span := otel.Tracer(traceProviderName).Start(instance.context, fmt.Sprintf("Use %s %s", method, path))
+	c, span := instance.tracerProvider.Tracer(traceProviderName).Start(instance.context, spanName)
 	defer span.End()
 	// End tracing
 
-	instance.paths[path] = struct{}{}
-	value := instance.trie.Get(path)
+	table := instance.routes().clone()
+	err := change(table)
+	if err == nil {
+		err = table.buildMux()
+	}
+	if err != nil {
+		span.RecordError(err)
+		instance.logger.WarnContext(c, "route change rejected", "change", spanName, "error", err)
+		return err
+	}
+	instance.table.Store(table)
+	instance.logger.DebugContext(c, "routes changed", "change", spanName)
+	return nil
+}
+
+func namedHandlers(handlers []RequestHandler) []routeHandler {
+	chain := make([]routeHandler, 0, len(handlers))
+	for _, handler := range handlers {
+		chain = append(chain, routeHandler{
+			name:    handlerName(handler),
+			handler: handler,
+		})
+	}
+	return chain
+}
+
+// clone copies the table for a change, handler slices are clipped so that appending to them copies too.
+func (table *routeTable) clone() *routeTable {
+	next := &routeTable{
+		trie:  trie.NewPathTrie(),
+		paths: make(map[string]struct{}, len(table.paths)),
+		globalHandlers: internalGlobalHandlers{
+			beforeAll: slices.Clip(table.globalHandlers.beforeAll),
+			afterAll:  slices.Clip(table.globalHandlers.afterAll),
+		},
+		mux: table.mux,
+	}
+	for path := range table.paths {
+		route := table.trie.Get(path).(methodHandlers)
+		copied := make(methodHandlers, len(route))
+		for method, handlers := range route {
+			copied[method] = slices.Clip(handlers)
+		}
+		next.trie.Put(path, copied)
+		next.paths[path] = struct{}{}
+	}
+	return next
+}
+
+// route returns the route for path, or nil when path is not registered.
+func (table *routeTable) route(path string) methodHandlers {
+	value := table.trie.Get(path)
 	if value == nil {
-		value = make(Route)
+		return nil
+	}
+	return value.(methodHandlers)
+}
+
+// setHandlers replaces the handler chain for path and method, an empty chain removes it.
+func (table *routeTable) setHandlers(path string, method HTTPMethod, handlers []routeHandler) {
+	route := table.route(path)
+	if route == nil {
+		route = make(methodHandlers)
 	}
-	if value.(Route)[method] == nil || len(value.(Route)[method]) == 0 {
-		value.(Route)[method] = []RequestHandler{}
+	if len(handlers) > 0 {
+		route[method] = handlers
+	} else {
+		delete(route, method)
+	}
+	if len(route) == 0 {
+		table.trie.Delete(path)
+		delete(table.paths, path)
+		return
 	}
-	value.(Route)[method] = append(value.(Route)[method], handler)
-	instance.trie.Put(path, value)
+	table.trie.Put(path, route)
+	table.paths[path] = struct{}{}
+}
+
+// buildMux rebuilds the mux after the table's paths changed.
+// It fails with a PatternError for a path the mux rejects, e.g. one conflicting with another under Go 1.22 patterns.
+func (table *routeTable) buildMux() error {
+	mux := http.NewServeMux()
+	for path := range table.paths {
+		if err := handleRecovering(mux, path); err != nil {
+			return err
+		}
+	}
+	table.mux = mux
+	return nil
+}
+
+// handleRecovering registers path on mux, ServeMux panics on patterns it rejects.
+func handleRecovering(mux *http.ServeMux, path string) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = &PatternError{Pattern: path, Err: fmt.Errorf("%v", recovered)}
+		}
+	}()
+	mux.Handle(path, routeMatch(path))
+	return nil
+}
+
+// match returns the route template for r, or "" when no route matches.
+// A non-nil handler is a redirect net/http issues itself, e.g. from "/docs" to the route "/docs/".
+func (table *routeTable) match(r *http.Request) (string, http.Handler) {
+	handler, pattern := table.mux.Handler(r)
+	if route, ok := handler.(routeMatch); ok {
+		return string(route), nil
+	}
+	if pattern == "" {
+		return "", nil
+	}
+	return "", handler
+}
+
+// handlers returns the handler chain for path and method, and the methods path has handlers for.
+func (table *routeTable) handlers(path string, method HTTPMethod) ([]routeHandler, []string) {
+	value := table.trie.Get(path)
+	if value == nil {
+		return nil, nil
+	}
+	allowed := []string{}
+	for routeMethod, handlers := range value.(methodHandlers) {
+		if len(handlers) > 0 {
+			allowed = append(allowed, string(routeMethod))
+		}
+	}
+	sort.Strings(allowed)
+	return value.(methodHandlers)[method], allowed
+}
+
+// globalHandlerChain returns the before-all or after-all global handlers.
+func (table *routeTable) globalHandlerChain(before bool) []GlobalHandler {
+	if before {
+		return table.globalHandlers.beforeAll
+	}
+	return table.globalHandlers.afterAll
 }
 
 // Convenience methods for each HTTP method
@@ -146,23 +414,33 @@ func (instance *Router) Head(path string, handler RequestHandler) {
 	instance.Use(path, HEAD, handler)
 }
 
-func convertToConcreteGlobalRouteOptions(options *GlobalRouteOptions) *concreteGlobalRouteOptions {
+func convertToConcreteGlobalRouteOptions(options *GlobalRouteOptions) (*concreteGlobalRouteOptions, error) {
 	concrete := concreteGlobalRouteOptions{
 		afterAll:           false,
 		ignoredPathRegexes: []regexp.Regexp{},
 	}
 	if options == nil {
-		return &concrete
+		return &concrete, nil
 	}
-	if options.ignoredPathRegexes != nil && len(options.ignoredPathRegexes) > 0 {
-		for _, regex := range options.ignoredPathRegexes {
+	if options.IgnoredPathRegexes != nil && len(options.IgnoredPathRegexes) > 0 {
+		for _, regex := range options.IgnoredPathRegexes {
 			compiled, err := regexp.Compile(regex)
 			if err != nil {
-				log.Fatal(err)
+				return nil, &PatternError{Pattern: regex, Err: err}
 			}
 			concrete.ignoredPathRegexes = append(concrete.ignoredPathRegexes, *compiled)
 		}
 	}
-	concrete.afterAll = options.afterAll
-	return &concrete
+	concrete.afterAll = options.AfterAll
+	return &concrete, nil
+}
+
+// handlerName reflects the function name of handler without its package path, e.g. "grouter.authenticate".
+func handlerName(handler RequestHandler) string {
+	function := runtime.FuncForPC(reflect.ValueOf(handler).Pointer())
+	if function == nil {
+		return "handler"
+	}
+	name := function.Name()
+	return name[strings.LastIndex(name, "/")+1:]
 }
@@ -1,11 +1,45 @@
 package grouter
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -15,30 +49,98 @@ const (
 
 var testingContext = context.Background()
 
-func TestSingletonServer(t *testing.T) {
-	server := GetServer(&testingContext, nil)
-	anotherServer := GetServer(&testingContext, nil)
+func TestIndependentServers(t *testing.T) {
+	server := NewTestServer(t)
+	anotherServer := NewTestServer(t)
+
+	if server == anotherServer || server.router == anotherServer.router {
+		t.Errorf("Expected every server to be independent")
+	}
+	server.Use("/test", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	GetClient(server, port, false, true, func(client *http.Client) {
+		GetClient(anotherServer, tlsPort, false, true, func(anotherClient *http.Client) {
+			res, err := client.Get(fmt.Sprintf("http://localhost:%d/test", port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("Expected status code 200, got %d", res.StatusCode)
+			}
+
+			res, err = anotherClient.Get(fmt.Sprintf("http://localhost:%d/test", tlsPort))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusNotFound {
+				t.Errorf("Expected routes of one server to not be served by another, got %d", res.StatusCode)
+			}
+		})
+	})
+}
 
-	if server != anotherServer {
-		t.Errorf("Expected server to be a singleton")
+func TestDefaultTracingPerServer(t *testing.T) {
+	global := otel.GetTracerProvider()
+	servers := []*Server{}
+	for i := 0; i < 2; i++ {
+		server, err := NewServer(WithContext(testingContext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.runHooks(testingContext, phaseClose)
+		servers = append(servers, server)
+	}
+	if err := servers[1].SetResourceConfig(&ResourceConfig{ServiceName: "another"}); err != nil {
+		t.Fatal(err)
 	}
+	if servers[0].tracerProvider == servers[1].tracerProvider {
+		t.Errorf("Expected every server to have its own default tracer provider")
+	}
+	if otel.GetTracerProvider() != global {
+		t.Errorf("Expected the global tracer provider to be left to the host process")
+	}
+}
+
+func TestSetRouter(t *testing.T) {
+	server := NewTestServer(t)
 	oldRouter := server.router
-	anotherServer = server.SetRouter(NewRouter(testingContext))
+	if err := server.SetRouter(NewRouter(testingContext)); err != nil {
+		t.Fatal(err)
+	}
+
+	if oldRouter == server.router {
+		t.Errorf("Expected router to be changed")
+	}
+}
 
-	if oldRouter == anotherServer.router || server != anotherServer {
-		t.Errorf("Expected router change to not change server instance")
+func TestNewServerOptions(t *testing.T) {
+	router := NewRouter(testingContext)
+	server, err := NewServer(WithContext(testingContext), WithRouter(router))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.router != router || server.context != testingContext {
+		t.Errorf("Expected options to be applied")
+	}
+	if _, err := NewServer(WithTLSConfig(&TLSConfig{CertFilePath: "missing.pem", KeyFilePath: "test.key.pem"})); !errors.Is(err, ErrInvalidTLSFiles) {
+		t.Errorf("Expected a missing certificate file to be rejected with ErrInvalidTLSFiles, got %v", err)
 	}
 }
 
 func TestServerUse(t *testing.T) {
-	server := GetServer(&testingContext, nil).SetRouter(NewRouter(testingContext))
+	server := NewTestServer(t)
 	server.Use("/test", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
 		next()
 		return nil
 	})
 
-	route := server.router.trie.Get("/test")
-	if route == nil || len(route.(Route)[GET]) != 1 {
+	route := server.router.routes().trie.Get("/test")
+	if route == nil || len(route.(methodHandlers)[GET]) != 1 {
 		t.Errorf("Expected GET \"/test\" to be initialized")
 	}
 
@@ -47,31 +149,31 @@ func TestServerUse(t *testing.T) {
 		return nil
 	})
 
-	route = server.router.trie.Get("/test")
-	if route == nil || len(route.(Route)[GET]) != 2 {
+	route = server.router.routes().trie.Get("/test")
+	if route == nil || len(route.(methodHandlers)[GET]) != 2 {
 		t.Errorf("Expected \"/test\" to be initialized")
 	}
 
-	if len(route.(Route)[POST]) > 0 {
+	if len(route.(methodHandlers)[POST]) > 0 {
 		t.Errorf("Expected POST \"/test\" to not be initialized")
 	}
 }
 
 func TestRoot(t *testing.T) {
-	server := GetServer(&testingContext, nil).SetRouter(NewRouter(testingContext))
+	server := NewTestServer(t)
 	server.Use("/", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
 		next()
 		return nil
 	})
 
-	route := server.router.trie.Get("/")
-	if route == nil || len(route.(Route)[GET]) != 1 {
+	route := server.router.routes().trie.Get("/")
+	if route == nil || len(route.(methodHandlers)[GET]) != 1 {
 		t.Errorf("Expected GET \"/\" to be initialized")
 	}
 }
 
 func TestHandlersForPath(t *testing.T) {
-	server := GetServer(&testingContext, nil).SetRouter(NewRouter(testingContext))
+	server := NewTestServer(t)
 	tracker := make(map[string]struct{})
 	server.Use("/test", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
 		tracker["first"] = struct{}{}
@@ -104,7 +206,7 @@ func TestHandlersForPath(t *testing.T) {
 }
 
 func TestHandlersForPathNoHandlers(t *testing.T) {
-	server := GetServer(&testingContext, nil).SetRouter(NewRouter(testingContext))
+	server := NewTestServer(t)
 
 	GetClient(server, port, false, true, func(client *http.Client) {
 		res, err := client.Get(fmt.Sprintf("http://localhost:%d/test", port))
@@ -118,7 +220,7 @@ func TestHandlersForPathNoHandlers(t *testing.T) {
 }
 
 func TestHandlersForPathNoHandlersForMethod(t *testing.T) {
-	server := GetServer(&testingContext, nil).SetRouter(NewRouter(testingContext))
+	server := NewTestServer(t)
 	server.Use("/test", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
 		next()
 		return nil
@@ -136,7 +238,7 @@ func TestHandlersForPathNoHandlersForMethod(t *testing.T) {
 }
 
 func TestHandlersForPathNoHandlersForPath(t *testing.T) {
-	server := GetServer(&testingContext, nil).SetRouter(NewRouter(testingContext))
+	server := NewTestServer(t)
 	server.Use("/test", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
 		next()
 		return nil
@@ -155,7 +257,7 @@ func TestHandlersForPathNoHandlersForPath(t *testing.T) {
 }
 
 func TestHandlersForPathNoHandlersForPathNoHandlersForMethod(t *testing.T) {
-	server := GetServer(&testingContext, nil).SetRouter(NewRouter(testingContext))
+	server := NewTestServer(t)
 	server.Use("/test", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
 		next()
 		return nil
@@ -174,7 +276,7 @@ func TestHandlersForPathNoHandlersForPathNoHandlersForMethod(t *testing.T) {
 }
 
 func TestHandlersForPathNoResponse(t *testing.T) {
-	server := GetServer(&testingContext, nil).SetRouter(NewRouter(testingContext))
+	server := NewTestServer(t)
 	server.Use("/test", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
 		next()
 		return nil
@@ -193,7 +295,7 @@ func TestHandlersForPathNoResponse(t *testing.T) {
 }
 
 func TestGlobalHandlers(t *testing.T) {
-	server := GetServer(&testingContext, nil).SetRouter(NewRouter(testingContext))
+	server := NewTestServer(t)
 	tracker := make(map[string]int)
 	server.UseGlobal(func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
 		tracker["before"] = 1
@@ -205,8 +307,8 @@ func TestGlobalHandlers(t *testing.T) {
 		next()
 		return nil
 	}, &GlobalRouteOptions{
-		afterAll:           false,
-		ignoredPathRegexes: []string{"/test2"},
+		AfterAll:           false,
+		IgnoredPathRegexes: []string{"/test2"},
 	})
 	server.Use("/test", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
 		tracker["test"] = 1
@@ -219,8 +321,8 @@ func TestGlobalHandlers(t *testing.T) {
 		next()
 		return nil
 	}, &GlobalRouteOptions{
-		afterAll:           true,
-		ignoredPathRegexes: nil,
+		AfterAll:           true,
+		IgnoredPathRegexes: nil,
 	})
 
 	GetClient(server, port, false, true, func(client *http.Client) {
@@ -245,7 +347,7 @@ func TestGlobalHandlers(t *testing.T) {
 }
 
 func TestGlobalHandlersIgnoredPaths(t *testing.T) {
-	server := GetServer(&testingContext, nil).SetRouter(NewRouter(testingContext))
+	server := NewTestServer(t)
 	tracker := make(map[string]int)
 	server.UseGlobal(func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
 		tracker["before"] = 1
@@ -257,8 +359,8 @@ func TestGlobalHandlersIgnoredPaths(t *testing.T) {
 		next()
 		return nil
 	}, &GlobalRouteOptions{
-		afterAll:           false,
-		ignoredPathRegexes: []string{"/test"},
+		AfterAll:           false,
+		IgnoredPathRegexes: []string{"/test"},
 	})
 	server.Use("/test", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
 		tracker["test"] = 1
@@ -271,8 +373,8 @@ func TestGlobalHandlersIgnoredPaths(t *testing.T) {
 		next()
 		return nil
 	}, &GlobalRouteOptions{
-		afterAll:           true,
-		ignoredPathRegexes: nil,
+		AfterAll:           true,
+		IgnoredPathRegexes: nil,
 	})
 
 	GetClient(server, port, false, true, func(client *http.Client) {
@@ -297,7 +399,7 @@ func TestGlobalHandlersIgnoredPaths(t *testing.T) {
 }
 
 func TestGlobalHandlersCorrectOrder(t *testing.T) {
-	server := GetServer(&testingContext, nil).SetRouter(NewRouter(testingContext))
+	server := NewTestServer(t)
 	tracker := []string{}
 	server.UseGlobal(func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
 		tracker = append(tracker, "before")
@@ -315,8 +417,8 @@ func TestGlobalHandlersCorrectOrder(t *testing.T) {
 		next()
 		return nil
 	}, &GlobalRouteOptions{
-		afterAll:           true,
-		ignoredPathRegexes: nil,
+		AfterAll:           true,
+		IgnoredPathRegexes: nil,
 	})
 
 	GetClient(server, port, false, true, func(client *http.Client) {
@@ -341,10 +443,10 @@ func TestGlobalHandlersCorrectOrder(t *testing.T) {
 }
 
 func TestTLSServer(t *testing.T) {
-	server := GetServer(&testingContext, &TLSConfig{
+	server := NewTestServer(t, WithTLSConfig(&TLSConfig{
 		CertFilePath: "test.cert.pem",
 		KeyFilePath:  "test.key.pem",
-	}).SetRouter(NewRouter(testingContext))
+	}))
 	server.Use("/test", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
 		_, err := w.Write([]byte("Hello, world!"))
 		if err != nil {
@@ -366,34 +468,2099 @@ func TestTLSServer(t *testing.T) {
 	})
 }
 
-func GetClient(server *Server, p int, useTLS bool, willRestart bool, testFunc func(*http.Client)) {
-	// Channel to signal when the server has started
-	started, ended := make(chan struct{}), make(chan struct{})
-	go func() {
-		// Start the server in a separate goroutine
-		err := server.Listen(p, started)
-		if err != nil && err != http.ErrServerClosed {
-			fmt.Println(err)
+func TestResourceConfig(t *testing.T) {
+	t.Setenv("OTEL_SERVICE_NAME", "env-service")
+	t.Setenv("OTEL_RESOURCE_ATTRIBUTES", "team=env-team,region=eu")
+
+	res, err := newResource(&ResourceConfig{
+		ServiceName: "configured-service",
+		Environment: "production",
+		Attributes:  map[string]string{"team": "configured-team"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[attribute.Key]string{
+		semconv.ServiceNameKey:    "configured-service",
+		semconv.ServiceVersionKey: defaultServiceVersion,
+		environmentKey:            "production",
+		"team":                    "configured-team",
+		"region":                  "eu",
+	}
+	for key, value := range expected {
+		if actual, ok := res.Set().Value(key); !ok || actual.AsString() != value {
+			t.Errorf("Expected %s to be %q, got %q", key, value, actual.AsString())
 		}
-		// Signal that the server has stopped
-		close(ended)
-	}()
-	// Wait for the server to start
-	<-started
+	}
+}
 
-	var client *http.Client
-	if useTLS {
-		transport := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+func TestResourceConfigEnvironmentFallback(t *testing.T) {
+	t.Setenv("OTEL_SERVICE_NAME", "env-service")
+
+	res, err := newResource(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, _ := res.Set().Value(semconv.ServiceNameKey); actual.AsString() != "env-service" {
+		t.Errorf("Expected service name from OTEL_SERVICE_NAME, got %q", actual.AsString())
+	}
+	if actual, _ := res.Set().Value(environmentKey); actual.AsString() != defaultEnvironment {
+		t.Errorf("Expected default environment, got %q", actual.AsString())
+	}
+}
+
+func TestRequestSpanAttributes(t *testing.T) {
+	recorder, tracing := RecordSpans()
+	server := NewTestServer(t, tracing)
+	server.Use("/items/", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		_, err := w.Write([]byte("item"))
+		return err
+	})
+
+	GetClient(server, port, false, true, func(client *http.Client) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/items/42?full=true", port), nil)
+		if err != nil {
+			t.Fatal(err)
 		}
-		client = &http.Client{Transport: transport}
-	} else {
-		client = &http.Client{}
+		req.Header.Set("User-Agent", "grouter-test")
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	})
+
+	span := FindSpan(t, recorder, "GET /items/")
+	expected := map[attribute.Key]attribute.Value{
+		routeKey:              attribute.StringValue("/items/"),
+		urlPathKey:            attribute.StringValue("/items/42"),
+		urlQueryKey:           attribute.StringValue("full=true"),
+		serverAddressKey:      attribute.StringValue("localhost"),
+		serverPortKey:         attribute.IntValue(port),
+		clientAddressKey:      attribute.StringValue("127.0.0.1"),
+		userAgentKey:          attribute.StringValue("grouter-test"),
+		protocolVersionKey:    attribute.StringValue("1.1"),
+		responseStatusCodeKey: attribute.IntValue(http.StatusOK),
+		responseBodySizeKey:   attribute.IntValue(4),
 	}
-	testFunc(client)
+	attributes := attribute.NewSet(span.Attributes()...)
+	for key, value := range expected {
+		if actual, ok := attributes.Value(key); !ok || actual != value {
+			t.Errorf("Expected %s to be %v, got %v", key, value.Emit(), actual.Emit())
+		}
+	}
+}
 
-	if err := server.Shutdown(willRestart); err != nil {
-		fmt.Println(err)
+func TestRequestMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	server := NewTestServer(t, WithMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))))
+	server.Use("/test", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		_, err := w.Write([]byte("ok"))
+		return err
+	})
+	server.Use("/error", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		return fmt.Errorf("handler failed")
+	})
+	server.Use("/panic", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		panic("handler panicked")
+	})
+
+	GetClient(server, port, false, true, func(client *http.Client) {
+		for _, path := range []string{"/test", "/error", "/panic"} {
+			res, err := client.Get(fmt.Sprintf("http://localhost:%d%s", port, path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if path == "/panic" && res.StatusCode != http.StatusInternalServerError {
+				t.Errorf("Expected status code 500 after a panic, got %d", res.StatusCode)
+			}
+		}
+		// Made-up methods on unmatched paths share a single series
+		for _, method := range []string{"BREW", "WHEN"} {
+			req, err := http.NewRequest(method, fmt.Sprintf("http://localhost:%d/missing", port), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+		}
+	})
+
+	var data metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &data); err != nil {
+		t.Fatal(err)
 	}
-	<-ended // Wait for the server to stop
+	metrics := map[string]metricdata.Aggregation{}
+	for _, scope := range data.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			metrics[m.Name] = m.Data
+		}
+	}
+
+	duration, ok := metrics["http.server.request.duration"].(metricdata.Histogram[float64])
+	if !ok || len(duration.DataPoints) != 4 {
+		t.Fatalf("Expected a duration histogram per route and one for unmatched requests")
+	}
+	for _, point := range duration.DataPoints {
+		if method, _ := point.Attributes.Value(requestMethodKey); method.AsString() == otherMethod {
+			if point.Count != 2 || point.Attributes.HasValue(routeKey) {
+				t.Errorf("Expected unknown methods to be recorded as %s without a route", otherMethod)
+			}
+		}
+		if route, _ := point.Attributes.Value(routeKey); route.AsString() == "/test" {
+			if status, _ := point.Attributes.Value(responseStatusCodeKey); status.AsInt64() != http.StatusOK {
+				t.Errorf("Expected /test to be labelled with status 200, got %d", status.AsInt64())
+			}
+		}
+	}
+	for name, route := range map[string]string{"grouter.handler.errors": "/error", "grouter.handler.panics": "/panic"} {
+		sum, ok := metrics[name].(metricdata.Sum[int64])
+		if !ok || len(sum.DataPoints) != 1 || sum.DataPoints[0].Value != 1 {
+			t.Fatalf("Expected %s to be counted once", name)
+		}
+		if actual, _ := sum.DataPoints[0].Attributes.Value(routeKey); actual.AsString() != route {
+			t.Errorf("Expected %s to be labelled with %s, got %s", name, route, actual.AsString())
+		}
+	}
+	active, ok := metrics["http.server.active_requests"].(metricdata.Sum[int64])
+	if !ok {
+		t.Fatalf("Expected active requests to be recorded")
+	}
+	for _, point := range active.DataPoints {
+		if point.Value != 0 {
+			t.Errorf("Expected no active requests after the test, got %d", point.Value)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	server := NewTestServer(t)
+	server.UseMetricsEndpoint("/metrics")
+	server.Use("/test", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+
+	GetClient(server, port, false, true, func(client *http.Client) {
+		res, err := client.Get(fmt.Sprintf("http://localhost:%d/test", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		for _, method := range []string{"BREW", "WHEN"} {
+			req, err := http.NewRequest(method, fmt.Sprintf("http://localhost:%d/missing", port), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+		}
+
+		res, err = client.Get(fmt.Sprintf("http://localhost:%d/metrics", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if contentType := res.Header.Get("Content-Type"); contentType != prometheusContentType {
+			t.Errorf("Expected Prometheus content type, got %q", contentType)
+		}
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range []string{
+			`grouter_http_requests_total{route="/test",method="GET",status="204"} 1`,
+			`grouter_http_request_duration_seconds_bucket{route="/test",method="GET",le="+Inf"} 1`,
+			`grouter_http_request_duration_seconds_count{route="/test",method="GET"} 1`,
+			`grouter_http_requests_total{route="",method="_OTHER",status="404"} 2`,
+			`grouter_http_requests_in_flight 1`,
+			"# TYPE go_goroutines gauge",
+		} {
+			if !strings.Contains(string(body), line+"\n") {
+				t.Errorf("Expected metrics to contain %q", line)
+			}
+		}
+	})
+}
+
+func TestPrometheusLabelEscaping(t *testing.T) {
+	var buffer bytes.Buffer
+	writeSample(&buffer, "sample", 1.5, "route", "/a\"b\\c\nd")
+	if expected := `sample{route="/a\"b\\c\nd"} 1.5` + "\n"; buffer.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buffer.String())
+	}
+}
+
+func TestHandlerSpans(t *testing.T) {
+	recorder, tracing := RecordSpans()
+	server := NewTestServer(t, tracing)
+	server.UseGlobalNamed("audit", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		next()
+		return nil
+	}, nil)
+	server.UseNamed("/test", GET, "authenticate", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		next()
+		return nil
+	})
+	server.Use("/test", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		return fmt.Errorf("handler failed")
+	})
+
+	GetClient(server, port, false, true, func(client *http.Client) {
+		res, err := client.Get(fmt.Sprintf("http://localhost:%d/test", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	})
+
+	audit := FindSpan(t, recorder, "audit")
+	authenticate := FindSpan(t, recorder, "authenticate")
+	reflected := FindSpan(t, recorder, "grouter.TestHandlerSpans.func3")
+	for span, expected := range map[sdktrace.ReadOnlySpan][]attribute.KeyValue{
+		audit:        {attribute.String(handlerKindKey, beforeAllHandlerKind), attribute.Bool(handlerNextCalledKey, true)},
+		authenticate: {attribute.String(handlerKindKey, routeHandlerKind), attribute.Bool(handlerNextCalledKey, true)},
+		reflected:    {attribute.String(handlerKindKey, routeHandlerKind), attribute.Bool(handlerNextCalledKey, false)},
+	} {
+		attributes := attribute.NewSet(span.Attributes()...)
+		for _, kv := range expected {
+			if actual, _ := attributes.Value(kv.Key); actual != kv.Value {
+				t.Errorf("Expected %s of span %s to be %v, got %v", kv.Key, span.Name(), kv.Value.Emit(), actual.Emit())
+			}
+		}
+	}
+	if reflected.Status().Code != codes.Error || len(reflected.Events()) != 1 {
+		t.Errorf("Expected the returned error to be recorded on the handler span")
+	}
+}
+
+func TestRequestSpanErrors(t *testing.T) {
+	recorder, tracing := RecordSpans()
+	server := NewTestServer(t, tracing)
+	server.UseNamed("/panic", GET, "panicking", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		panic("handler panicked")
+	})
+	server.Use("/error", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		return fmt.Errorf("handler failed")
+	})
+	server.Use("/redirect", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		http.Redirect(w, r, "/error", http.StatusFound)
+		return nil
+	})
+	server.Use("/docs/", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	GetClient(server, port, false, true, func(client *http.Client) {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		for _, request := range [][2]string{{"GET", "/panic"}, {"GET", "/error"}, {"GET", "/redirect"}, {"POST", "/error"}, {"GET", "/missing"}, {"GET", "/docs"}} {
+			req, err := http.NewRequest(request[0], fmt.Sprintf("http://localhost:%d%s", port, request[1]), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+		}
+	})
+
+	for _, name := range []string{"panicking", "GET /panic"} {
+		span := FindSpan(t, recorder, name)
+		if span.Status().Code != codes.Error || len(span.Events()) != 1 {
+			t.Fatalf("Expected the panic to be recorded on %s", name)
+		}
+		attributes := attribute.NewSet(span.Events()[0].Attributes...)
+		stacktrace, _ := attributes.Value("exception.stacktrace")
+		if !strings.Contains(stacktrace.AsString(), "TestRequestSpanErrors") {
+			t.Errorf("Expected the stack of the panic to be recorded on %s", name)
+		}
+	}
+	if span := FindSpan(t, recorder, "GET /error"); span.Status().Code != codes.Error || len(span.Events()) != 1 || span.Events()[0].Name != "exception" {
+		t.Errorf("Expected the returned error to be recorded on the request span")
+	}
+	for name, event := range map[string]string{
+		"GET /redirect": routeRedirectEvent,
+		"POST /error":   routeMethodNotAllowedEvent,
+	} {
+		span := FindSpan(t, recorder, name)
+		if len(span.Events()) != 1 || span.Events()[0].Name != event {
+			t.Errorf("Expected %s to record the %s event", name, event)
+		}
+	}
+	// Unmatched requests and the redirects of the mux have no route template
+	unmatched := map[string]string{}
+	for _, span := range recorder.Ended() {
+		if span.Name() == "GET" && len(span.Events()) == 1 {
+			attributes := attribute.NewSet(span.Attributes()...)
+			path, _ := attributes.Value(urlPathKey)
+			unmatched[path.AsString()] = span.Events()[0].Name
+		}
+	}
+	if unmatched["/missing"] != routeNotFoundEvent || unmatched["/docs"] != routeRedirectEvent {
+		t.Errorf("Expected the unmatched request and the mux redirect to record their events, got %v", unmatched)
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	recorder, tracing := RecordSpans()
+	server := NewTestServer(t, tracing)
+	var buffer bytes.Buffer
+	server.SetLogger(slog.New(slog.NewJSONHandler(&buffer, nil)))
+	server.UseNamed("/test", GET, "logging", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		LoggerFromContext(ctx).Info("without context")
+		LoggerFromContext(ctx).InfoContext(ctx, "with context")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	GetClient(server, port, false, true, func(client *http.Client) {
+		res, err := client.Get(fmt.Sprintf("http://localhost:%d/test", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	})
+
+	requestSpan := FindSpan(t, recorder, "GET /test")
+	handlerSpan := FindSpan(t, recorder, "logging")
+	expectedSpans := map[string]sdktrace.ReadOnlySpan{"without context": requestSpan, "with context": handlerSpan}
+	decoder := json.NewDecoder(&buffer)
+	for {
+		var record map[string]any
+		if err := decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		span, exists := expectedSpans[record["msg"].(string)]
+		if !exists {
+			continue
+		}
+		delete(expectedSpans, record["msg"].(string))
+		if record[traceIDKey] != span.SpanContext().TraceID().String() || record[spanIDKey] != span.SpanContext().SpanID().String() {
+			t.Errorf("Expected %q to be correlated with span %s, got %v", record["msg"], span.Name(), record)
+		}
+		if record[urlPathKey] != "/test" {
+			t.Errorf("Expected %q to carry the request path, got %v", record["msg"], record)
+		}
+	}
+	if len(expectedSpans) > 0 {
+		t.Errorf("Expected every handler record to be logged")
+	}
+}
+
+func TestRejectedPatterns(t *testing.T) {
+	handler := func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		return nil
+	}
+	server := NewTestServer(t)
+	if err := server.Handle("", GET, handler); !errors.Is(err, ErrBadPattern) {
+		t.Errorf("Expected a path the mux rejects to fail with ErrBadPattern, got %v", err)
+	}
+	// Use cannot return the error, the change is rejected instead of panicking
+	server.Use("", GET, handler)
+	if len(server.router.routes().paths) != 0 {
+		t.Errorf("Expected the rejected paths not to be registered")
+	}
+
+	// Go 1.22 patterns reject conflicting wildcards, which needs the new mux from the start of the process
+	if os.Getenv("GODEBUG") != "httpmuxgo121=0" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestRejectedPatterns$")
+		cmd.Env = append(os.Environ(), "GODEBUG=httpmuxgo121=0")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("Expected conflicting patterns to be rejected with the Go 1.22 mux: %v\n%s", err, output)
+		}
+		return
+	}
+	if err := server.Handle("/a/{x}", GET, handler); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Handle("/a/{y}", GET, handler); !errors.Is(err, ErrBadPattern) {
+		t.Errorf("Expected a conflicting pattern to fail with ErrBadPattern, got %v", err)
+	}
+	if len(server.router.routes().paths) != 1 {
+		t.Errorf("Expected the conflicting path not to be registered")
+	}
+}
+
+func TestRouterLogger(t *testing.T) {
+	server := NewTestServer(t)
+	var buffer bytes.Buffer
+	server.SetLogger(slog.New(slog.NewJSONHandler(&buffer, nil)))
+	handler := func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		return nil
+	}
+	if err := server.Handle("/test", GET, handler); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Handle("/test", GET, handler); !errors.Is(err, ErrDuplicateRoute) {
+		t.Fatalf("Expected ErrDuplicateRoute, got %v", err)
+	}
+	var record map[string]any
+	if err := json.Unmarshal(buffer.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single record for the rejected change, got %q", buffer.String())
+	}
+	if record["msg"] != "route change rejected" || record["change"] != "Handle GET /test" {
+		t.Errorf("Expected the router to log the rejected change, got %v", record)
+	}
+}
+
+func TestAccessLogger(t *testing.T) {
+	server := NewTestServer(t)
+	var common, combined, jsonLines bytes.Buffer
+	server.Use("/items/", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		_, err := w.Write([]byte("item"))
+		return err
+	})
+
+	for _, logger := range []*AccessLogger{
+		NewAccessLogger(&common, CommonLogFormat),
+		NewAccessLogger(&combined, CombinedLogFormat),
+		NewAccessLogger(&jsonLines, JSONLogFormat),
+	} {
+		server.UseAccessLogger(logger)
+		GetClient(server, port, false, true, func(client *http.Client) {
+			req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/items/42?full=true", port), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("User-Agent", "grouter-test")
+			req.SetBasicAuth("alice", "secret")
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+		})
+	}
+
+	commonPattern := `^127\.0\.0\.1 - alice \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /items/42\?full=true HTTP/1\.1" 200 4`
+	if !regexp.MustCompile(commonPattern + "\n$").MatchString(common.String()) {
+		t.Errorf("Unexpected common log line %q", common.String())
+	}
+	if !regexp.MustCompile(commonPattern + ` "-" "grouter-test"\n$`).MatchString(combined.String()) {
+		t.Errorf("Unexpected combined log line %q", combined.String())
+	}
+	var entry accessLogEntry
+	if err := json.Unmarshal(jsonLines.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Route != "/items/" || entry.Path != "/items/42" || entry.Status != http.StatusOK || entry.Bytes != 4 || entry.DurationMS <= 0 {
+		t.Errorf("Unexpected JSON log line %q", jsonLines.String())
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	file, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for suffix, expected := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+		content, err := os.ReadFile(path + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Errorf("Expected %s%s to contain %q, got %q", path, suffix, expected, content)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 backups to be kept")
+	}
+}
+
+func TestRotatingFileFailedRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	file, err := NewRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	// A non-empty directory in the way of the backup makes the rename fail
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocked"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("second\n")); err == nil {
+		t.Fatal("Expected the rotation to fail")
+	}
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file stays usable and rotates once the rename succeeds
+	if _, err := file.Write([]byte("third\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for suffix, expected := range map[string]string{"": "third\n", ".1": "first\n"} {
+		content, err := os.ReadFile(path + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Errorf("Expected %s%s to contain %q, got %q", path, suffix, expected, content)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	server := NewTestServer(t)
+
+	err := server.UseGlobal(func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		next()
+		return nil
+	}, &GlobalRouteOptions{IgnoredPathRegexes: []string{"/health", "/("}})
+	var patternErr *PatternError
+	if !errors.Is(err, ErrBadPattern) || !errors.As(err, &patternErr) || patternErr.Pattern != "/(" {
+		t.Errorf("Expected an invalid pattern to fail with ErrBadPattern, got %v", err)
+	}
+	if len(server.router.routes().globalHandlers.beforeAll) != 0 {
+		t.Errorf("Expected the handler to not be registered")
+	}
+
+	err = server.SetTLSConfig(&TLSConfig{CertFilePath: "test.cert.pem", KeyFilePath: "missing.pem"})
+	var tlsErr *TLSFileError
+	if !errors.Is(err, ErrInvalidTLSFiles) || !errors.As(err, &tlsErr) || tlsErr.Path != "missing.pem" {
+		t.Errorf("Expected a missing key file to fail with ErrInvalidTLSFiles, got %v", err)
+	}
+	if server.tls != nil {
+		t.Errorf("Expected the TLS config to be left unchanged")
+	}
+
+	GetClient(server, port, false, true, func(client *http.Client) {
+		if err := server.Listen(port, make(chan struct{})); !errors.Is(err, ErrAlreadyServing) {
+			t.Errorf("Expected a second Listen to fail with ErrAlreadyServing, got %v", err)
+		}
+	})
+}
+
+func TestNewServerOptionValidation(t *testing.T) {
+	for name, option := range map[string]ServerOption{
+		"address":         WithAddress("localhost"),
+		"read timeout":    WithReadTimeout(-time.Second),
+		"write timeout":   WithWriteTimeout(-time.Second),
+		"idle timeout":    WithIdleTimeout(-time.Second),
+		"header timeout":  WithReadHeaderTimeout(-time.Second),
+		"max header":      WithMaxHeaderBytes(0),
+		"logger":          WithLogger(nil),
+		"tracer provider": WithTracerProvider(nil),
+		"error handler":   WithErrorHandler(nil),
+		"base context":    WithBaseContext(nil),
+		"drain period":    WithDrainPeriod(-time.Second),
+		"shutdown":        WithShutdownTimeout(-time.Second),
+		"redirect port": WithTLSConfig(&TLSConfig{
+			CertFilePath: "test.cert.pem",
+			KeyFilePath:  "test.key.pem",
+			Redirect:     &RedirectConfig{HTTPSPort: 70000},
+		}),
+	} {
+		if _, err := NewServer(option); err == nil {
+			t.Errorf("Expected an invalid %s to be rejected", name)
+		}
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	server := NewTestServer(t,
+		WithAddress(fmt.Sprintf("127.0.0.1:%d", port)),
+		WithReadTimeout(time.Second),
+		WithWriteTimeout(2*time.Second),
+		WithMaxHeaderBytes(4096),
+	)
+	server.Use("/test", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	started, ended := make(chan struct{}), make(chan struct{})
+	go func() {
+		if err := server.ListenAndServe(started); err != nil && err != http.ErrServerClosed {
+			t.Error(err)
+		}
+		close(ended)
+	}()
+	<-started
+	res, err := (&http.Client{Transport: &http.Transport{}}).Get(fmt.Sprintf("http://127.0.0.1:%d/test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	httpServer := server.listeners.servers[0]
+	if httpServer.ReadTimeout != time.Second || httpServer.WriteTimeout != 2*time.Second || httpServer.MaxHeaderBytes != 4096 {
+		t.Errorf("Expected configured limits to be applied")
+	}
+	if httpServer.ReadHeaderTimeout != defaultReadHeaderTimeout || httpServer.IdleTimeout != defaultIdleTimeout {
+		t.Errorf("Expected default timeouts to be applied")
+	}
+	if err := server.Shutdown(true); err != nil {
+		t.Fatal(err)
+	}
+	<-ended
+}
+
+func TestErrorHandler(t *testing.T) {
+	errs := []error{}
+	server := NewTestServer(t, WithErrorHandler(func(ctx context.Context, w *ResponseWriter, r *http.Request, err error) {
+		errs = append(errs, err)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	server.Use("/error", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		return fmt.Errorf("handler failed")
+	})
+	server.Use("/panic", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		panic("handler panicked")
+	})
+
+	GetClient(server, port, false, true, func(client *http.Client) {
+		for _, path := range []string{"/error", "/panic"} {
+			res, err := client.Get(fmt.Sprintf("http://localhost:%d%s", port, path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusTeapot {
+				t.Errorf("Expected the error handler to respond to %s, got %d", path, res.StatusCode)
+			}
+		}
+	})
+	if len(errs) != 2 || errs[0].Error() != "handler failed" || errs[1].Error() != "panic: handler panicked" {
+		t.Errorf("Expected the error handler to receive both errors, got %v", errs)
+	}
+}
+
+func TestBaseContext(t *testing.T) {
+	type key struct{}
+	server := NewTestServer(t, WithBaseContext(context.WithValue(context.Background(), key{}, "base")))
+	server.Use("/test", GET, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		if ctx.Value(key{}) != "base" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return nil
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	GetClient(server, port, false, true, func(client *http.Client) {
+		res, err := client.Get(fmt.Sprintf("http://localhost:%d/test", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("Expected handlers to see values of the base context")
+		}
+	})
+}
+
+func TestConcurrentRegistration(t *testing.T) {
+	server := NewTestServer(t)
+	server.Get("/concurrent", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	GetClient(server, port, false, true, func(client *http.Client) {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				// Handlers appended to a served path run after the first one responded
+				server.Get("/concurrent", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+					return nil
+				})
+				server.Get("/registered-while-serving", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+					w.WriteHeader(http.StatusOK)
+					return nil
+				})
+			}()
+			go func() {
+				defer wg.Done()
+				res, err := client.Get(fmt.Sprintf("http://localhost:%d/concurrent", port))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					t.Errorf("Expected status code 200, got %d", res.StatusCode)
+				}
+			}()
+		}
+		wg.Wait()
+
+		// Paths registered while serving are routed without restarting the listener
+		res, err := client.Get(fmt.Sprintf("http://localhost:%d/registered-while-serving", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("Expected status code 200, got %d", res.StatusCode)
+		}
+	})
+}
+
+func TestConcurrentLifecycle(t *testing.T) {
+	server := NewTestServer(t)
+	started, ended := make(chan struct{}), make(chan struct{})
+	go func() {
+		server.Listen(port, started)
+		close(ended)
+	}()
+	<-started
+
+	// A second Listen is rejected while the first one serves
+	if err := server.Listen(port, make(chan struct{})); !errors.Is(err, ErrAlreadyServing) {
+		t.Errorf("Expected ErrAlreadyServing, got %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(true); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	<-ended
+
+	// A stopped server can listen again
+	GetClient(server, port, false, true, func(client *http.Client) {})
+}
+
+func TestHotRouterSwap(t *testing.T) {
+	server := NewTestServer(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	server.Get("/slow", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	GetClient(server, port, false, true, func(client *http.Client) {
+		slow := make(chan int)
+		go func() {
+			res, err := client.Get(fmt.Sprintf("http://localhost:%d/slow", port))
+			if err != nil {
+				t.Error(err)
+				close(slow)
+				return
+			}
+			res.Body.Close()
+			slow <- res.StatusCode
+		}()
+		// Wait for the slow request to be in flight on the old router
+		<-started
+
+		router := NewRouter(testingContext)
+		router.Get("/new", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+			w.WriteHeader(http.StatusAccepted)
+			return nil
+		})
+		if err := server.SetRouter(router); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := client.Get(fmt.Sprintf("http://localhost:%d/new", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusAccepted {
+			t.Errorf("Expected the new router to serve /new, got %d", res.StatusCode)
+		}
+		res, err = client.Get(fmt.Sprintf("http://localhost:%d/slow", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected /slow to be gone from the new router, got %d", res.StatusCode)
+		}
+
+		// The in-flight request finishes with the old routes
+		close(release)
+		if status := <-slow; status != http.StatusOK {
+			t.Errorf("Expected the in-flight request to finish with 200, got %d", status)
+		}
+	})
+}
+
+func TestRouteRemovalAndReplacement(t *testing.T) {
+	server := NewTestServer(t)
+	status := func(code int) RequestHandler {
+		return func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+			w.WriteHeader(code)
+			return nil
+		}
+	}
+	if err := server.Handle("/feature", GET, status(http.StatusOK)); err != nil {
+		t.Fatal(err)
+	}
+	err := server.Handle("/feature", GET, status(http.StatusOK))
+	var routeErr *RouteError
+	if !errors.Is(err, ErrDuplicateRoute) || !errors.As(err, &routeErr) || routeErr.Path != "/feature" || routeErr.Method != GET {
+		t.Errorf("Expected a second Handle to fail with ErrDuplicateRoute, got %v", err)
+	}
+	if err := server.Handle("/feature", POST, status(http.StatusCreated)); err != nil {
+		t.Errorf("Expected Handle for another method to succeed, got %v", err)
+	}
+
+	GetClient(server, port, false, true, func(client *http.Client) {
+		get := func(path string) int {
+			res, err := client.Get(fmt.Sprintf("http://localhost:%d%s", port, path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			return res.StatusCode
+		}
+
+		server.Replace("/feature", GET, status(http.StatusAccepted))
+		if code := get("/feature"); code != http.StatusAccepted {
+			t.Errorf("Expected the replaced handler to respond 202, got %d", code)
+		}
+		if !server.Remove("/feature", GET) {
+			t.Errorf("Expected Remove to report the removed route")
+		}
+		if server.Remove("/feature", GET) {
+			t.Errorf("Expected a second Remove to find nothing")
+		}
+		// POST still has handlers, so the path stays registered
+		if route := server.router.routes().route("/feature"); route == nil || len(route[POST]) != 1 {
+			t.Errorf("Expected POST \"/feature\" to be kept")
+		}
+		if code := get("/feature"); code != http.StatusNotFound {
+			t.Errorf("Expected the removed method to respond 404, got %d", code)
+		}
+		server.Remove("/feature", POST)
+		if _, exists := server.router.routes().paths["/feature"]; exists {
+			t.Errorf("Expected \"/feature\" to be unregistered")
+		}
+		if err := server.Handle("/feature", GET, status(http.StatusOK)); err != nil {
+			t.Errorf("Expected Handle to succeed after Remove, got %v", err)
+		}
+		if code := get("/feature"); code != http.StatusOK {
+			t.Errorf("Expected the handled route to respond 200, got %d", code)
+		}
+	})
+}
+
+func TestServeListener(t *testing.T) {
+	server := NewTestServer(t)
+	server.Get("/test", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ended := make(chan error)
+	go func() {
+		ended <- server.Serve(listener)
+	}()
+	// The listener is bound already, so requests queue until Serve accepts them
+	client := &http.Client{Transport: &http.Transport{}}
+	res, err := client.Get(fmt.Sprintf("http://%s/test", listener.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status code 200, got %d", res.StatusCode)
+	}
+	if addr := server.Addr(); addr == nil || addr.String() != listener.Addr().String() {
+		t.Errorf("Expected Addr to report %s, got %v", listener.Addr(), addr)
+	}
+	if err := server.Shutdown(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-ended; err != http.ErrServerClosed {
+		t.Errorf("Expected Serve to return http.ErrServerClosed, got %v", err)
+	}
+	if server.Addr() != nil {
+		t.Errorf("Expected a stopped server to have no address")
+	}
+
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ServeTLS(listener); !errors.Is(err, ErrTLSNotConfigured) {
+		t.Errorf("Expected ServeTLS without a TLS config to fail with ErrTLSNotConfigured, got %v", err)
+	}
+	if _, err := listener.Accept(); err == nil {
+		t.Errorf("Expected ServeTLS to close the listener")
+	}
+}
+
+func TestListenFailureClosesObserver(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	server := NewTestServer(t)
+	started, ended := make(chan struct{}), make(chan error, 1)
+	go func() {
+		ended <- server.ListenAll(started, Endpoint{Address: busy.Addr().String()})
+	}()
+	// A caller waiting on observer is released although the address is taken
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected observer to be closed when Listen fails")
+	}
+	if err := <-ended; err == nil {
+		t.Fatal("Expected an error binding a busy address")
+	}
+}
+
+func TestListenEphemeralPort(t *testing.T) {
+	server := NewTestServer(t)
+	started, ended := make(chan struct{}), make(chan struct{})
+	go func() {
+		server.Listen(0, started)
+		close(ended)
+	}()
+	<-started
+
+	// The port is bound once observer is closed
+	addr, ok := server.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("Expected Addr to report the chosen port, got %v", server.Addr())
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", addr.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := server.Shutdown(true); err != nil {
+		t.Fatal(err)
+	}
+	<-ended
+}
+
+func TestListenUnix(t *testing.T) {
+	// Socket paths are limited to ~100 bytes, t.TempDir can be longer
+	dir, err := os.MkdirTemp("", "grouter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "grouter.sock")
+
+	// Leave a stale socket behind, as a crashed server would
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	server := NewTestServer(t)
+	server.Get("/test", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	started, ended := make(chan struct{}), make(chan struct{})
+	go func() {
+		if err := server.ListenUnix(path, 0660, started); err != nil && err != http.ErrServerClosed {
+			t.Error(err)
+		}
+		close(ended)
+	}()
+	<-started
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("Expected socket permissions 0660, got %o", info.Mode().Perm())
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	res, err := client.Get("http://unix/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status code 200, got %d", res.StatusCode)
+	}
+
+	// A socket that is still served is left alone
+	other := NewTestServer(t)
+	if err := other.ListenUnix(path, 0, make(chan struct{})); !errors.Is(err, ErrSocketInUse) {
+		t.Errorf("Expected a served socket to fail with ErrSocketInUse, got %v", err)
+	}
+
+	if err := server.Shutdown(true); err != nil {
+		t.Fatal(err)
+	}
+	<-ended
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the socket to be removed on shutdown, got %v", err)
+	}
+}
+
+func TestListenAll(t *testing.T) {
+	server := NewTestServer(t, WithTLSConfig(&TLSConfig{
+		CertFilePath: "test.cert.pem",
+		KeyFilePath:  "test.key.pem",
+	}))
+	server.Get("/test", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	// An endpoint that cannot be bound keeps the others from being served
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.ListenAll(make(chan struct{}), Endpoint{Address: "127.0.0.1:0"}, Endpoint{Address: taken.Addr().String()})
+	taken.Close()
+	if err == nil || server.isServing() {
+		t.Fatalf("Expected ListenAll to fail without serving, got %v", err)
+	}
+
+	started, ended := make(chan struct{}), make(chan error)
+	go func() {
+		ended <- server.ListenAll(started, Endpoint{Address: "127.0.0.1:0"}, Endpoint{Address: "127.0.0.1:0", PlainHTTP: true})
+	}()
+	<-started
+
+	addrs := server.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("Expected 2 addresses, got %v", addrs)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for _, url := range []string{fmt.Sprintf("https://%s/test", addrs[0]), fmt.Sprintf("http://%s/test", addrs[1])} {
+		res, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("Expected status code 200 from %s, got %d", url, res.StatusCode)
+		}
+	}
+
+	if err := server.Shutdown(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-ended; err != http.ErrServerClosed {
+		t.Errorf("Expected ListenAll to return http.ErrServerClosed, got %v", err)
+	}
+	for _, addr := range addrs {
+		if conn, err := net.Dial("tcp", addr.String()); err == nil {
+			conn.Close()
+			t.Errorf("Expected %s to be closed", addr)
+		}
+	}
+}
+
+func TestRedirectListener(t *testing.T) {
+	server := NewTestServer(t, WithTLSConfig(&TLSConfig{
+		CertFilePath: "test.cert.pem",
+		KeyFilePath:  "test.key.pem",
+		Redirect: &RedirectConfig{
+			Address:               "127.0.0.1:0",
+			HSTSMaxAge:            time.Hour,
+			HSTSIncludeSubdomains: true,
+			PlainPaths:            []string{"/healthz"},
+		},
+	}))
+	for _, path := range []string{"/test", "/healthz", "/docs/"} {
+		server.Get(path, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+			w.WriteHeader(http.StatusOK)
+			return nil
+		})
+	}
+	var accessLog bytes.Buffer
+	server.UseAccessLogger(NewAccessLogger(&accessLog, CommonLogFormat))
+
+	started, ended := make(chan struct{}), make(chan struct{})
+	go func() {
+		server.ListenAll(started, Endpoint{Address: "127.0.0.1:0"})
+		close(ended)
+	}()
+	<-started
+
+	addrs := server.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("Expected the HTTPS and redirect addresses, got %v", addrs)
+	}
+	httpsAddr, httpAddr := addrs[0].(*net.TCPAddr), addrs[1]
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := client.Post(fmt.Sprintf("http://%s/test?q=1", httpAddr), "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusPermanentRedirect {
+		t.Errorf("Expected status code 308, got %d", res.StatusCode)
+	}
+	if location, expected := res.Header.Get("Location"), fmt.Sprintf("https://127.0.0.1:%d/test?q=1", httpsAddr.Port); location != expected {
+		t.Errorf("Expected a redirect to %s, got %s", expected, location)
+	}
+
+	res, err = client.Get(fmt.Sprintf("http://%s/healthz", httpAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Strict-Transport-Security") != "" {
+		t.Errorf("Expected /healthz to be served over plain HTTP without HSTS, got %d", res.StatusCode)
+	}
+
+	res, err = client.Get(fmt.Sprintf("https://%s/test", httpsAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if hsts := res.Header.Get("Strict-Transport-Security"); hsts != "max-age=3600; includeSubDomains" {
+		t.Errorf("Expected the HSTS header on HTTPS responses, got %q", hsts)
+	}
+
+	res, err = client.Get(fmt.Sprintf("https://%s/docs", httpsAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMovedPermanently {
+		t.Errorf("Expected the mux to redirect /docs to /docs/, got %d", res.StatusCode)
+	}
+
+	// A bare IPv6 Host keeps a single pair of brackets
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/test", httpAddr), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "[::1]"
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if location, expected := res.Header.Get("Location"), fmt.Sprintf("https://[::1]:%d/test", httpsAddr.Port); location != expected {
+		t.Errorf("Expected a redirect to %s, got %s", expected, location)
+	}
+
+	// Without a Host, as HTTP/1.0 allows, the redirect points to the address the request reached
+	conn, err := net.Dial("tcp", httpAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "GET /test HTTP/1.0\r\n\r\n")
+	res, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if location, expected := res.Header.Get("Location"), fmt.Sprintf("https://127.0.0.1:%d/test", httpsAddr.Port); res.StatusCode != http.StatusPermanentRedirect || location != expected {
+		t.Errorf("Expected a 308 to %s, got %d to %s", expected, res.StatusCode, location)
+	}
+
+	if err := server.Shutdown(true); err != nil {
+		t.Fatal(err)
+	}
+	<-ended
+	// Redirects are logged like the requests the routes serve
+	for _, line := range []string{`"POST /test?q=1 HTTP/1.1" 308`, `"GET /healthz HTTP/1.1" 200`, `"GET /test HTTP/1.1" 200`, `"GET /docs HTTP/1.1" 301`} {
+		if !strings.Contains(accessLog.String(), line) {
+			t.Errorf("Expected the access log to contain %s, got %s", line, accessLog.String())
+		}
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	server := NewTestServer(t, WithDrainPeriod(300*time.Millisecond), WithShutdownTimeout(100*time.Millisecond))
+	server.UseReadinessEndpoint("/ready")
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	server.Get("/slow", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	var mutex sync.Mutex
+	phases := []ShutdownPhase{}
+	for _, phase := range []ShutdownPhase{ShutdownDraining, ShutdownGraceful, ShutdownForced, ShutdownStopped} {
+		phase := phase
+		server.OnShutdownPhase(phase, func(ctx context.Context) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			phases = append(phases, phase)
+			return nil
+		})
+	}
+
+	listening, ended := make(chan struct{}), make(chan struct{})
+	go func() {
+		server.Listen(0, listening)
+		close(ended)
+	}()
+	<-listening
+	address := server.Addr().String()
+	client := &http.Client{Transport: &http.Transport{}}
+	ready := func() int {
+		res, err := client.Get(fmt.Sprintf("http://%s/ready", address))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if status := ready(); status != http.StatusOK || !server.Ready() {
+		t.Errorf("Expected a serving server to be ready, got %d", status)
+	}
+
+	slow := make(chan error)
+	go func() {
+		_, err := client.Get(fmt.Sprintf("http://%s/slow", address))
+		slow <- err
+	}()
+	<-started
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- server.Shutdown(true)
+	}()
+	// Requests are still served while draining, readiness reports unhealthy
+	for server.Ready() {
+		time.Sleep(time.Millisecond)
+	}
+	if status := ready(); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected readiness to report 503 while draining, got %d", status)
+	}
+
+	err := <-shutdown
+	var timeoutErr *ShutdownTimeoutError
+	if !errors.Is(err, ErrShutdownTimeout) || !errors.As(err, &timeoutErr) || timeoutErr.Interrupted != 1 {
+		t.Errorf("Expected Shutdown to report 1 interrupted request, got %v", err)
+	}
+	if err := <-slow; err == nil {
+		t.Errorf("Expected the interrupted request to fail")
+	}
+	<-ended
+	mutex.Lock()
+	defer mutex.Unlock()
+	if fmt.Sprint(phases) != fmt.Sprint([]ShutdownPhase{ShutdownDraining, ShutdownGraceful, ShutdownForced, ShutdownStopped}) {
+		t.Errorf("Expected every shutdown phase in order, got %v", phases)
+	}
+}
+
+func TestRunSignals(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	WriteCertificate(t, certPath, keyPath, "first")
+	server := NewTestServer(t, WithTLSConfig(&TLSConfig{CertFilePath: certPath, KeyFilePath: keyPath}))
+	reloaded := make(chan struct{}, 1)
+	server.OnReload(func(ctx context.Context) error {
+		reloaded <- struct{}{}
+		return nil
+	})
+
+	ran := make(chan error)
+	go func() {
+		ran <- server.Run(testingContext, Endpoint{Address: "127.0.0.1:0"})
+	}()
+	for !server.Ready() {
+		time.Sleep(time.Millisecond)
+	}
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := PeerCommonName(t, server.Addr().String()); name != "first" {
+		t.Errorf("Expected the first certificate, got %q", name)
+	}
+
+	// SIGHUP reloads the certificate without restarting the listener
+	WriteCertificate(t, certPath, keyPath, "second")
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	<-reloaded
+	if name := PeerCommonName(t, server.Addr().String()); name != "second" {
+		t.Errorf("Expected the reloaded certificate, got %q", name)
+	}
+
+	if err := process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-ran; err != nil {
+		t.Errorf("Expected Run to return nil after a graceful shutdown, got %v", err)
+	}
+	if server.isServing() {
+		t.Errorf("Expected the server to be stopped")
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	server := NewTestServer(t)
+	ctx, cancel := context.WithCancel(testingContext)
+	ran := make(chan error)
+	go func() {
+		ran <- server.Run(ctx, Endpoint{Address: "127.0.0.1:0"})
+	}()
+	for !server.Ready() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-ran; err != nil {
+		t.Errorf("Expected Run to return nil once ctx is cancelled, got %v", err)
+	}
+
+	// Cancelled before the server starts, or while its start hooks run
+	cancelled, cancel := context.WithCancel(testingContext)
+	cancel()
+	server = NewTestServer(t)
+	if err := RunWithin(t, server, cancelled); err != nil {
+		t.Errorf("Expected Run to return nil for a cancelled ctx, got %v", err)
+	}
+	ctx, cancel = context.WithCancel(testingContext)
+	server = NewTestServer(t)
+	server.OnStart(func(context.Context) error {
+		cancel()
+		return nil
+	})
+	if err := RunWithin(t, server, ctx); err != nil {
+		t.Errorf("Expected Run to return nil for a ctx cancelled by a start hook, got %v", err)
+	}
+	if server.Ready() {
+		t.Errorf("Expected the server to be stopped")
+	}
+}
+
+// RunWithin runs server until ctx is done and fails the test if Run does not return within a few seconds.
+func RunWithin(t *testing.T, server *Server, ctx context.Context) error {
+	ran := make(chan error, 1)
+	go func() {
+		ran <- server.Run(ctx, Endpoint{Address: "127.0.0.1:0"})
+	}()
+	select {
+	case err := <-ran:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to return once ctx is done")
+		return nil
+	}
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	server := NewTestServer(t)
+	var mutex sync.Mutex
+	events := []string{}
+	record := func(event string, err error) LifecycleHook {
+		return func(ctx context.Context) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			events = append(events, event)
+			return err
+		}
+	}
+	startErr := errors.New("database unavailable")
+	server.OnStart(record("start", startErr))
+	if err := server.Listen(0, make(chan struct{})); !errors.Is(err, startErr) {
+		t.Errorf("Expected a failing start hook to keep the server from listening, got %v", err)
+	}
+	if server.isServing() {
+		t.Errorf("Expected the server to be stopped after a failing start hook")
+	}
+
+	server = NewTestServer(t)
+	events = []string{}
+	// Hooks may call back into the server
+	server.OnStart(func(ctx context.Context) error {
+		server.Get("/registered-on-start", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+			w.WriteHeader(http.StatusOK)
+			return nil
+		})
+		return record("start", nil)(ctx)
+	})
+	server.OnReady(record("ready", nil))
+	firstErr, secondErr := errors.New("first"), errors.New("second")
+	server.OnShutdown(record("shutdown", firstErr))
+	server.OnStop(record("stop", secondErr))
+
+	started, ended := make(chan struct{}), make(chan struct{})
+	go func() {
+		server.Listen(0, started)
+		close(ended)
+	}()
+	<-started
+	res, err := (&http.Client{Transport: &http.Transport{}}).Get(fmt.Sprintf("http://%s/registered-on-start", server.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected the route registered by the start hook to be served, got %d", res.StatusCode)
+	}
+
+	err = server.Shutdown(true)
+	if !errors.Is(err, firstErr) || !errors.Is(err, secondErr) {
+		t.Errorf("Expected Shutdown to return every hook error, got %v", err)
+	}
+	<-ended
+	mutex.Lock()
+	defer mutex.Unlock()
+	if strings.Join(events, ",") != "start,ready,shutdown,stop" {
+		t.Errorf("Expected the hooks to run in lifecycle order, got %v", events)
+	}
+}
+
+func TestStopHooksAfterFailedStart(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	server := NewTestServer(t)
+	opened, closed := 0, 0
+	server.OnStart(func(ctx context.Context) error {
+		opened++
+		return nil
+	})
+	server.OnStop(func(ctx context.Context) error {
+		closed++
+		return nil
+	})
+	if err := server.ListenAll(nil, Endpoint{Address: busy.Addr().String()}); err == nil {
+		t.Fatal("Expected binding a busy port to fail")
+	}
+	if opened != 1 || closed != 1 {
+		t.Errorf("Expected the stop hooks to release what the start hooks opened, got opened=%d closed=%d", opened, closed)
+	}
+
+	// The first start hook's pool is released when the second one fails, and the third one is skipped
+	server = NewTestServer(t)
+	opened, closed = 0, 0
+	startErr := errors.New("cache unavailable")
+	server.OnStart(func(ctx context.Context) error {
+		opened++
+		return nil
+	})
+	server.OnStart(func(ctx context.Context) error {
+		return startErr
+	})
+	skipped := true
+	server.OnStart(func(ctx context.Context) error {
+		skipped = false
+		return nil
+	})
+	server.OnStop(func(ctx context.Context) error {
+		closed++
+		return nil
+	})
+	if err := server.ListenAll(nil, Endpoint{Address: "127.0.0.1:0"}); !errors.Is(err, startErr) {
+		t.Errorf("Expected the failing start hook's error, got %v", err)
+	}
+	if opened != 1 || closed != 1 || !skipped {
+		t.Errorf("Expected the stop hooks to run and the later start hooks to be skipped, got opened=%d closed=%d skipped=%v", opened, closed, skipped)
+	}
+}
+
+func TestShutdownWhileStarting(t *testing.T) {
+	server := NewTestServer(t)
+	ready := false
+	server.OnStart(func(ctx context.Context) error {
+		return server.Shutdown(true)
+	})
+	server.OnReady(func(ctx context.Context) error {
+		ready = true
+		return nil
+	})
+	stopped := false
+	server.OnStop(func(ctx context.Context) error {
+		stopped = true
+		return nil
+	})
+	if err := server.Listen(0, make(chan struct{})); err != http.ErrServerClosed {
+		t.Errorf("Expected a Shutdown during the start hooks to stop the server, got %v", err)
+	}
+	if ready || server.Addr() != nil || server.isServing() {
+		t.Errorf("Expected the server not to bind its endpoints")
+	}
+	if !stopped {
+		t.Errorf("Expected the stop hooks to run")
+	}
+}
+
+func TestSetTLSConfigWhileServing(t *testing.T) {
+	dir := t.TempDir()
+	first, second := &TLSConfig{}, &TLSConfig{}
+	for name, config := range map[string]*TLSConfig{"first": first, "second": second} {
+		config.CertFilePath, config.KeyFilePath = filepath.Join(dir, name+".cert.pem"), filepath.Join(dir, name+".key.pem")
+		WriteCertificate(t, config.CertFilePath, config.KeyFilePath, name)
+	}
+	server := NewTestServer(t, WithTLSConfig(first))
+	started, ended := make(chan struct{}), make(chan struct{})
+	go func() {
+		server.ListenAll(started, Endpoint{Address: "127.0.0.1:0"})
+		close(ended)
+	}()
+	<-started
+	address := server.Addr().String()
+
+	if err := server.SetTLSConfig(second); err != nil {
+		t.Fatal(err)
+	}
+	if !server.Ready() || server.Addr().String() != address {
+		t.Errorf("Expected the server to keep serving on %s", address)
+	}
+	if name := PeerCommonName(t, address); name != "second" {
+		t.Errorf("Expected new connections to get the new certificate, got %q", name)
+	}
+	if err := server.Shutdown(true); err != nil {
+		t.Fatal(err)
+	}
+	<-ended
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	config := &TLSConfig{
+		CertFilePath:   filepath.Join(dir, "cert.pem"),
+		KeyFilePath:    filepath.Join(dir, "key.pem"),
+		ReloadInterval: 10 * time.Millisecond,
+	}
+	WriteCertificate(t, config.CertFilePath, config.KeyFilePath, "first")
+	server := NewTestServer(t, WithTLSConfig(config))
+	started, ended := make(chan struct{}), make(chan struct{})
+	go func() {
+		server.ListenAll(started, Endpoint{Address: "127.0.0.1:0"})
+		close(ended)
+	}()
+	<-started
+	address := server.Addr().String()
+
+	// Rotated files are picked up without Reload
+	WriteCertificate(t, config.CertFilePath, config.KeyFilePath, "second-certificate")
+	deadline := time.Now().Add(5 * time.Second)
+	for PeerCommonName(t, address) != "second-certificate" {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the rotated certificate to be served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A broken pair keeps the last good one, on change and on Reload
+	if err := os.WriteFile(config.CertFilePath, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if name := PeerCommonName(t, address); name != "second-certificate" {
+		t.Errorf("Expected the last good certificate to be kept, got %q", name)
+	}
+	if err := server.Reload(); !errors.Is(err, ErrInvalidTLSFiles) {
+		t.Errorf("Expected Reload to fail with ErrInvalidTLSFiles, got %v", err)
+	}
+	if name := PeerCommonName(t, address); name != "second-certificate" {
+		t.Errorf("Expected the last good certificate to be kept, got %q", name)
+	}
+
+	if err := server.Shutdown(true); err != nil {
+		t.Fatal(err)
+	}
+	<-ended
+}
+
+func TestServerNameCertificates(t *testing.T) {
+	dir := t.TempDir()
+	pair := func(name string, serverNames ...string) CertificatePair {
+		pair := CertificatePair{
+			ServerNames:  serverNames,
+			CertFilePath: filepath.Join(dir, name+".cert.pem"),
+			KeyFilePath:  filepath.Join(dir, name+".key.pem"),
+		}
+		WriteCertificate(t, pair.CertFilePath, pair.KeyFilePath, name)
+		return pair
+	}
+	fallback := pair("default")
+	config := &TLSConfig{
+		CertFilePath: fallback.CertFilePath,
+		KeyFilePath:  fallback.KeyFilePath,
+		Certificates: []CertificatePair{
+			pair("api", "api.example.com"),
+			pair("wildcard", "*.example.com"),
+			// Served for the certificate's own DNS name, localhost
+			pair("local"),
+		},
+	}
+	server := NewTestServer(t, WithTLSConfig(config))
+	started, ended := make(chan struct{}), make(chan struct{})
+	go func() {
+		server.ListenAll(started, Endpoint{Address: "127.0.0.1:0"})
+		close(ended)
+	}()
+	<-started
+	address := server.Addr().String()
+
+	for serverName, expected := range map[string]string{
+		"api.example.com": "api",
+		"API.Example.com": "api",
+		"www.example.com": "wildcard",
+		"a.b.example.com": "default",
+		"example.com":     "default",
+		"localhost":       "local",
+		"other.org":       "default",
+		"":                "default",
+	} {
+		if name := PeerCommonNameFor(t, address, serverName); name != expected {
+			t.Errorf("Expected %q to get the %s certificate, got %s", serverName, expected, name)
+		}
+	}
+	if err := server.Shutdown(true); err != nil {
+		t.Fatal(err)
+	}
+	<-ended
+
+	// Without a default pair the first one is the default
+	for _, config := range []*TLSConfig{{}, {Certificates: []CertificatePair{pair("bad", "*.*.example.com")}}} {
+		if err := server.SetTLSConfig(config); !errors.Is(err, ErrInvalidTLSFiles) {
+			t.Errorf("Expected ErrInvalidTLSFiles for %+v, got %v", config, err)
+		}
+	}
+	if err := server.SetTLSConfig(&TLSConfig{Certificates: config.Certificates}); err != nil {
+		t.Fatal(err)
+	}
+	started, ended = make(chan struct{}), make(chan struct{})
+	go func() {
+		server.ListenAll(started, Endpoint{Address: "127.0.0.1:0"})
+		close(ended)
+	}()
+	<-started
+	if name := PeerCommonNameFor(t, server.Addr().String(), "other.org"); name != "api" {
+		t.Errorf("Expected the first pair to be the default, got %s", name)
+	}
+	if err := server.Shutdown(true); err != nil {
+		t.Fatal(err)
+	}
+	<-ended
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	config := &TLSConfig{
+		CertFilePath:     filepath.Join(dir, "cert.pem"),
+		KeyFilePath:      filepath.Join(dir, "key.pem"),
+		ClientCAFilePath: filepath.Join(dir, "ca.pem"),
+		ClientAuth:       ClientAuthVerifyIfGiven,
+	}
+	WriteCertificate(t, config.CertFilePath, config.KeyFilePath, "server")
+	issue := WriteClientCA(t, config.ClientCAFilePath)
+	allowed := issue("api", "spiffe://mesh.internal/ns/payments/sa/api")
+	other := issue("worker", "spiffe://other.internal/ns/jobs/sa/worker")
+
+	server := NewTestServer(t, WithTLSConfig(config))
+	server.Get("/whoami", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		identity, ok := ClientIdentityFromRequest(r)
+		if !ok {
+			_, err := w.Write([]byte("anonymous"))
+			return err
+		}
+		_, err := w.Write([]byte(fmt.Sprintf("%s %s %t", identity.Subject.CommonName, identity.SPIFFEID, identity.Verified)))
+		return err
+	})
+	server.Use("/admin", GET, RequireClientIdentity(ClientIdentityPolicy{TrustDomains: []string{"mesh.internal"}}))
+	server.Get("/admin", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	started, ended := make(chan struct{}), make(chan struct{})
+	go func() {
+		server.ListenAll(started, Endpoint{Address: "127.0.0.1:0"})
+		close(ended)
+	}()
+	<-started
+	address := server.Addr().String()
+
+	get := func(certificate *tls.Certificate, path string) (int, string, error) {
+		tlsConfig := &tls.Config{InsecureSkipVerify: true}
+		if certificate != nil {
+			tlsConfig.Certificates = []tls.Certificate{*certificate}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		res, err := client.Get(fmt.Sprintf("https://%s%s", address, path))
+		if err != nil {
+			return 0, "", err
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		return res.StatusCode, string(body), err
+	}
+	for _, test := range []struct {
+		certificate *tls.Certificate
+		path        string
+		status      int
+		body        string
+	}{
+		{nil, "/whoami", http.StatusOK, "anonymous"},
+		{&allowed, "/whoami", http.StatusOK, "api spiffe://mesh.internal/ns/payments/sa/api true"},
+		{nil, "/admin", http.StatusForbidden, ""},
+		{&other, "/admin", http.StatusForbidden, ""},
+		{&allowed, "/admin", http.StatusOK, ""},
+	} {
+		status, body, err := get(test.certificate, test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != test.status || body != test.body {
+			t.Errorf("Expected %s to answer %d %q, got %d %q", test.path, test.status, test.body, status, body)
+		}
+	}
+
+	// Requiring a certificate refuses clients without one during the handshake
+	required := *config
+	required.ClientAuth = ClientAuthRequire
+	if err := server.SetTLSConfig(&required); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := get(nil, "/whoami"); err == nil {
+		t.Errorf("Expected a client without a certificate to be refused")
+	}
+	if status, _, err := get(&allowed, "/admin"); err != nil || status != http.StatusOK {
+		t.Errorf("Expected a verified client to be allowed, got %d %v", status, err)
+	}
+	if err := server.Shutdown(true); err != nil {
+		t.Fatal(err)
+	}
+	<-ended
+
+	for _, invalid := range []*TLSConfig{
+		{CertFilePath: config.CertFilePath, KeyFilePath: config.KeyFilePath, ClientAuth: ClientAuthRequire},
+		{CertFilePath: config.CertFilePath, KeyFilePath: config.KeyFilePath, ClientAuth: ClientAuthMode(42)},
+		{CertFilePath: config.CertFilePath, KeyFilePath: config.KeyFilePath, ClientCAFilePath: filepath.Join(dir, "missing.pem")},
+	} {
+		if err := server.SetTLSConfig(invalid); !errors.Is(err, ErrInvalidTLSFiles) {
+			t.Errorf("Expected ErrInvalidTLSFiles for %+v, got %v", invalid, err)
+		}
+	}
+}
+
+func TestCertificateReloadAfterRejectedConfig(t *testing.T) {
+	dir := t.TempDir()
+	config := &TLSConfig{
+		CertFilePath:   filepath.Join(dir, "cert.pem"),
+		KeyFilePath:    filepath.Join(dir, "key.pem"),
+		ReloadInterval: 10 * time.Millisecond,
+	}
+	WriteCertificate(t, config.CertFilePath, config.KeyFilePath, "current")
+	broken := &TLSConfig{CertFilePath: filepath.Join(dir, "broken.pem"), KeyFilePath: config.KeyFilePath}
+	if err := os.WriteFile(broken.CertFilePath, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	server := NewTestServer(t, WithTLSConfig(config))
+	server.SetLogger(slog.New(slog.NewJSONHandler(&buffer, nil)))
+	started, ended := make(chan struct{}), make(chan struct{})
+	go func() {
+		server.ListenAll(started, Endpoint{Address: "127.0.0.1:0"})
+		close(ended)
+	}()
+	<-started
+
+	if err := server.SetTLSConfig(broken); !errors.Is(err, ErrInvalidTLSFiles) {
+		t.Fatalf("Expected the broken config to be rejected, got %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if name := PeerCommonName(t, server.Addr().String()); name != "current" {
+		t.Errorf("Expected the current certificate to be kept, got %q", name)
+	}
+	if err := server.Shutdown(true); err != nil {
+		t.Fatal(err)
+	}
+	<-ended
+	if strings.Contains(buffer.String(), "reloaded changed TLS certificates") {
+		t.Errorf("Expected the unchanged files not to be reloaded, got %s", buffer.String())
+	}
+}
+
+const restartChildEnv = "GROUTER_TEST_RESTART_CHILD"
+
+func TestRestart(t *testing.T) {
+	server := NewTestServer(t)
+	server.Get("/", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		_, err := w.Write([]byte("parent"))
+		return err
+	})
+	started, ended := make(chan struct{}), make(chan struct{})
+	go func() {
+		server.ListenAll(started, Endpoint{Address: "127.0.0.1:0"})
+		close(ended)
+	}()
+	<-started
+	address := server.Addr().String()
+
+	// The new process runs TestRestartChild, which listens on the same endpoint
+	restartArguments = func() []string {
+		return []string{"-test.run=^TestRestartChild$"}
+	}
+	defer func() {
+		restartArguments = func() []string { return os.Args[1:] }
+	}()
+	t.Setenv(restartChildEnv, "1")
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	<-ended
+
+	client := &http.Client{Transport: &http.Transport{}}
+	res, err := client.Get(fmt.Sprintf("http://%s/", address))
+	if err != nil {
+		t.Fatalf("Expected the new process to serve on %s: %v", address, err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "child" {
+		t.Errorf("Expected the new process to answer, got %q", body)
+	}
+	if res, err := client.Get(fmt.Sprintf("http://%s/stop", address)); err == nil {
+		res.Body.Close()
+	}
+}
+
+// TestRestartChild is the process TestRestart starts, it serves the listener it inherits until /stop is requested.
+func TestRestartChild(t *testing.T) {
+	if os.Getenv(restartChildEnv) == "" {
+		t.Skip("only runs in the process started by TestRestart")
+	}
+	server := NewTestServer(t)
+	server.Get("/", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		_, err := w.Write([]byte("child"))
+		return err
+	})
+	server.Get("/stop", func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		w.WriteHeader(http.StatusOK)
+		go server.Shutdown(true)
+		return nil
+	})
+	if err := server.ListenAll(nil, Endpoint{Address: "127.0.0.1:0"}); err != http.ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+func TestInheritedListenersForAnotherProcess(t *testing.T) {
+	// systemd activation meant for another PID must be ignored
+	t.Setenv(listenFDsEnv, "1")
+	t.Setenv(listenPIDEnv, strconv.Itoa(os.Getpid()+1))
+	inherited.listeners, inherited.err = nil, nil
+	loadInheritedListeners()
+	if len(inherited.listeners) != 0 || inherited.err != nil {
+		t.Errorf("Expected no inherited listeners, got %v, %v", inherited.listeners, inherited.err)
+	}
+	if os.Getenv(listenFDsEnv) != "" {
+		t.Errorf("Expected the activation environment to be removed")
+	}
+}
+
+// NewTestServer returns a new server using the testing context that discards its spans unless told otherwise.
+func NewTestServer(t *testing.T, options ...ServerOption) *Server {
+	defaults := []ServerOption{WithContext(testingContext), WithTracerProvider(trace.NewNoopTracerProvider())}
+	server, err := NewServer(append(defaults, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// RecordSpans returns an in-memory span recorder and the option to send a server's spans to it.
+func RecordSpans() (*tracetest.SpanRecorder, ServerOption) {
+	recorder := tracetest.NewSpanRecorder()
+	return recorder, WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+}
+
+// FindSpan returns the first ended span with the given name.
+func FindSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	t.Fatalf("Expected a span named %q", name)
+	return nil
+}
+
+func GetClient(server *Server, p int, useTLS bool, willRestart bool, testFunc func(*http.Client)) {
+	// Channel to signal when the server has started
+	started, ended := make(chan struct{}), make(chan struct{})
+	var listenErr error
+	go func() {
+		// Start the server in a separate goroutine
+		listenErr = server.Listen(p, started)
+		// Signal that the server has stopped
+		close(ended)
+	}()
+	// Wait for the server to start, started is also closed when Listen fails
+	<-started
+	select {
+	case <-ended:
+		if listenErr != http.ErrServerClosed {
+			fmt.Println(listenErr)
+		}
+		return
+	default:
+	}
+
+	var client *http.Client
+	if useTLS {
+		transport := &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		client = &http.Client{Transport: transport}
+	} else {
+		// Own transport so that no keep-alive connection to a previous server is reused
+		client = &http.Client{Transport: &http.Transport{}}
+	}
+	testFunc(client)
+
+	if err := server.Shutdown(willRestart); err != nil {
+		fmt.Println(err)
+	}
+	<-ended // Wait for the server to stop
+	if listenErr != nil && listenErr != http.ErrServerClosed {
+		fmt.Println(listenErr)
+	}
+}
+
+// WriteCertificate writes a self-signed certificate for localhost and 127.0.0.1 with the given common name.
+func WriteCertificate(t *testing.T, certPath string, keyPath string, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// WriteClientCA writes a CA certificate to caPath and returns a function issuing client certificates signed by it.
+func WriteClientCA(t *testing.T, caPath string) func(commonName string, spiffeID string) tls.Certificate {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return func(commonName string, spiffeID string) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uri, err := url.Parse(spiffeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: commonName},
+			URIs:         []*url.URL{uri},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+}
+
+// PeerCommonName returns the common name of the certificate address presents on a new connection.
+func PeerCommonName(t *testing.T, address string) string {
+	return PeerCommonNameFor(t, address, "")
+}
+
+// PeerCommonNameFor is PeerCommonName for a client requesting serverName.
+func PeerCommonNameFor(t *testing.T, address string, serverName string) string {
+	conn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true, ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
 }
@@ -0,0 +1,283 @@
+package grouter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Environment of systemd socket activation, which Restart also uses to pass listeners to the new process
+const (
+	listenFDsEnv     = "LISTEN_FDS"
+	listenFDNamesEnv = "LISTEN_FDNAMES"
+	listenPIDEnv     = "LISTEN_PID"
+	// readyFDEnv is the pipe the new process writes to once it serves, so that the old one can drain
+	readyFDEnv = "GROUTER_READY_FD"
+	// The first passed file descriptor, after stdin, stdout and stderr
+	listenFDsStart = 3
+)
+
+// InheritedListener is a listening socket passed to this process by Restart or systemd socket activation.
+type InheritedListener struct {
+	// Name is the systemd FileDescriptorName, or the endpoint the listener was bound for by Restart
+	Name     string
+	Listener net.Listener
+}
+
+var inherited struct {
+	once      sync.Once
+	listeners []InheritedListener
+	err       error
+}
+
+// InheritedListeners returns the passed listeners that no endpoint has claimed yet, e.g. to Serve them.
+// Listen and ListenAll claim the listener passed for their address by Restart before binding a new one.
+func InheritedListeners() ([]InheritedListener, error) {
+	inherited.once.Do(loadInheritedListeners)
+	claimed.Lock()
+	defer claimed.Unlock()
+	return unclaimedListeners(inherited.listeners, claimed.names), inherited.err
+}
+
+var claimed = struct {
+	sync.Mutex
+	names map[string]struct{}
+}{names: make(map[string]struct{})}
+
+// claimInherited returns the listener Restart passed for endpoint, or nil.
+func claimInherited(network string, address string) net.Listener {
+	inherited.once.Do(loadInheritedListeners)
+	name := endpointName(network, address)
+	claimed.Lock()
+	defer claimed.Unlock()
+	if _, taken := claimed.names[name]; taken {
+		return nil
+	}
+	for _, listener := range inherited.listeners {
+		if listener.Name == name {
+			claimed.names[name] = struct{}{}
+			return listener.Listener
+		}
+	}
+	return nil
+}
+
+func unclaimedListeners(listeners []InheritedListener, names map[string]struct{}) []InheritedListener {
+	remaining := []InheritedListener{}
+	for _, listener := range listeners {
+		if _, taken := names[listener.Name]; !taken {
+			remaining = append(remaining, listener)
+		}
+	}
+	return remaining
+}
+
+// loadInheritedListeners reads the listeners from the environment and removes it, so that child processes do not see it.
+func loadInheritedListeners() {
+	defer os.Unsetenv(listenFDsEnv)
+	defer os.Unsetenv(listenFDNamesEnv)
+	defer os.Unsetenv(listenPIDEnv)
+
+	count := os.Getenv(listenFDsEnv)
+	if count == "" {
+		return
+	}
+	// systemd sets the PID of the process the listeners are meant for, another process may have inherited the environment
+	if pid := os.Getenv(listenPIDEnv); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		inherited.err = fmt.Errorf("grouter: invalid %s %q", listenFDsEnv, count)
+		return
+	}
+	names := strings.Split(os.Getenv(listenFDNamesEnv), ":")
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(listenFDsStart+i), name)
+		listener, err := net.FileListener(file)
+		// FileListener duplicates the descriptor
+		file.Close()
+		if err != nil {
+			inherited.err = errors.Join(inherited.err, fmt.Errorf("grouter: inherited listener %s: %w", name, err))
+			continue
+		}
+		inherited.listeners = append(inherited.listeners, InheritedListener{Name: name, Listener: listener})
+	}
+}
+
+// endpointName names the listener of an endpoint in LISTEN_FDNAMES, whose names cannot contain ':'.
+func endpointName(network string, address string) string {
+	return url.QueryEscape(network + "/" + address)
+}
+
+var readyNotification sync.Once
+
+// restartArguments are the arguments of the process Restart starts, tests replace them to run a single test.
+var restartArguments = func() []string {
+	return os.Args[1:]
+}
+
+// notifyReady tells the process that started this one with Restart that it can drain.
+func notifyReady() {
+	readyNotification.Do(func() {
+		value := os.Getenv(readyFDEnv)
+		os.Unsetenv(readyFDEnv)
+		fd, err := strconv.Atoi(value)
+		if value == "" || err != nil {
+			return
+		}
+		pipe := os.NewFile(uintptr(fd), "ready")
+		pipe.Write([]byte{1})
+		pipe.Close()
+	})
+}
+
+// Restart starts a new process of the same executable with the same arguments and passes it the server's listeners,
+// then shuts this server down once the new process serves. No connection is refused in between.
+// If the new process exits or does not serve within the shutdown timeout, this server keeps serving and Restart fails.
+// The caller exits once Restart returns nil.
+func (instance *Server) Restart() error {
+	instance.mutex.RLock()
+	// Start tracing
+	c, span := instance.tracerProvider.Tracer(traceProviderName).Start(instance.context, "Restart")
+	defer span.End()
+	// End tracing
+	group, serving := instance.listeners, instance.state == stateServing
+	timeout := instance.shutdownTimeout
+	logger := instance.logger
+	instance.mutex.RUnlock()
+	if !serving || group == nil {
+		return ErrNotServing
+	}
+
+	files := []*os.File{}
+	names := []string{}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for i, listener := range group.listeners {
+		file, err := listenerFile(listener)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+		names = append(names, group.names[i])
+	}
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyRead.Close()
+	files = append(files, readyWrite)
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(executable, restartArguments()...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(withoutListenEnvironment(os.Environ()),
+		listenFDsEnv+"="+strconv.Itoa(len(names)),
+		listenFDNamesEnv+"="+strings.Join(names, ":"),
+		readyFDEnv+"="+strconv.Itoa(listenFDsStart+len(names)),
+	)
+	if err := cmd.Start(); err != nil {
+		span.RecordError(err)
+		return err
+	}
+	// Only the new process holds the write end now, so reading fails if it exits
+	readyWrite.Close()
+	files = files[:len(files)-1]
+	logger.InfoContext(c, "started new process", "pid", cmd.Process.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyRead.Read(make([]byte, 1))
+		ready <- err
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Wait()
+			err = fmt.Errorf("grouter: new process exited before serving: %w", err)
+			span.RecordError(err)
+			return err
+		}
+	case <-expired:
+		cmd.Process.Kill()
+		cmd.Wait()
+		err := errors.New("grouter: new process did not serve within the shutdown timeout")
+		span.RecordError(err)
+		return err
+	}
+	pid := cmd.Process.Pid
+	// The new process is not waited for, it outlives this one
+	cmd.Process.Release()
+
+	// Unix sockets are now shared, closing them here must not remove the file
+	for _, listener := range group.listeners {
+		if unix, ok := listener.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false)
+		}
+	}
+	logger.InfoContext(c, "new process is serving, shutting down", "pid", pid)
+	return instance.Shutdown(false)
+}
+
+// listenerFile duplicates the descriptor of listener for a new process.
+// Unlike the File method of net listeners, it leaves the descriptor non-blocking when exec passes it,
+// which the listener shares with it and keeps accepting on.
+func listenerFile(listener net.Listener) (*os.File, error) {
+	conn, ok := listener.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("grouter: cannot pass a %T to a new process", listener)
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var duplicate int
+	var dupErr error
+	if err := raw.Control(func(fd uintptr) {
+		duplicate, dupErr = dupCloseOnExec(int(fd))
+	}); err != nil {
+		return nil, err
+	}
+	if dupErr != nil {
+		return nil, os.NewSyscallError("dup", dupErr)
+	}
+	return os.NewFile(uintptr(duplicate), listener.Addr().String()), nil
+}
+
+func withoutListenEnvironment(environment []string) []string {
+	filtered := []string{}
+	for _, variable := range environment {
+		name, _, _ := strings.Cut(variable, "=")
+		if name == listenFDsEnv || name == listenFDNamesEnv || name == listenPIDEnv || name == readyFDEnv {
+			continue
+		}
+		filtered = append(filtered, variable)
+	}
+	return filtered
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package grouter
+
+import "errors"
+
+// dupCloseOnExec is unsupported, listeners cannot be passed to a new process on this platform.
+func dupCloseOnExec(int) (int, error) {
+	return -1, errors.ErrUnsupported
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package grouter
+
+import "syscall"
+
+// dupCloseOnExec duplicates fd, the duplicate is only inherited through exec.Cmd.ExtraFiles.
+func dupCloseOnExec(fd int) (int, error) {
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	duplicate, err := syscall.Dup(fd)
+	if err != nil {
+		return -1, err
+	}
+	syscall.CloseOnExec(duplicate)
+	return duplicate, nil
+}
@@ -0,0 +1,93 @@
+package grouter
+
+import (
+	"context"
+	"errors"
+)
+
+// LifecycleHook runs when the server reaches a point of its lifecycle,
+// its error is returned by the method that ran it without stopping the remaining hooks, except at start.
+type LifecycleHook func(context.Context) error
+
+// lifecyclePhase is a point of the server's lifecycle that hooks run at.
+type lifecyclePhase int
+
+const (
+	phaseStart lifecyclePhase = iota
+	phaseReady
+	phaseReload
+	phaseDraining
+	phaseGraceful
+	phaseForced
+	phaseStopped
+	// phaseClose releases grouter's own resources, e.g. the default trace files, when the server will not restart
+	phaseClose
+)
+
+var shutdownPhases = map[ShutdownPhase]lifecyclePhase{
+	ShutdownDraining: phaseDraining,
+	ShutdownGraceful: phaseGraceful,
+	ShutdownForced:   phaseForced,
+	ShutdownStopped:  phaseStopped,
+}
+
+// OnStart registers hook to run before the server binds its endpoints, e.g. to open a database pool.
+// If a hook fails the later start hooks are skipped and the server does not listen,
+// the stop hooks run to release what the earlier ones acquired, and Listen returns the error.
+func (instance *Server) OnStart(hook LifecycleHook) {
+	instance.addHook(phaseStart, hook)
+}
+
+// OnReady registers hook to run once every endpoint is bound, e.g. to register with service discovery.
+// If a hook fails the server shuts down, and Listen returns the hooks' errors.
+func (instance *Server) OnReady(hook LifecycleHook) {
+	instance.addHook(phaseReady, hook)
+}
+
+// OnShutdown registers hook to run when Shutdown is called, before the server drains.
+func (instance *Server) OnShutdown(hook LifecycleHook) {
+	instance.addHook(phaseDraining, hook)
+}
+
+// OnStop registers hook to run once the server has stopped, e.g. to close a database pool.
+func (instance *Server) OnStop(hook LifecycleHook) {
+	instance.addHook(phaseStopped, hook)
+}
+
+// OnShutdownPhase registers hook to run when Shutdown reaches phase, hooks of a phase run in registration order.
+func (instance *Server) OnShutdownPhase(phase ShutdownPhase, hook LifecycleHook) {
+	instance.addHook(shutdownPhases[phase], hook)
+}
+
+// OnReload registers hook to run on every Reload, e.g. to re-read application configuration.
+func (instance *Server) OnReload(hook LifecycleHook) {
+	instance.addHook(phaseReload, hook)
+}
+
+func (instance *Server) addHook(phase lifecyclePhase, hook LifecycleHook) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	if instance.hooks == nil {
+		instance.hooks = make(map[lifecyclePhase][]LifecycleHook)
+	}
+	instance.hooks[phase] = append(instance.hooks[phase], hook)
+}
+
+// runHooks runs every hook of phase in registration order and joins their errors.
+// Start hooks stop at the first error, a later hook may depend on what an earlier one acquired.
+// The server's mutex must not be held, hooks may call back into the server.
+func (instance *Server) runHooks(ctx context.Context, phase lifecyclePhase) error {
+	instance.mutex.RLock()
+	hooks := instance.hooks[phase]
+	instance.mutex.RUnlock()
+	var errs []error
+	for _, hook := range hooks {
+		if err := hook(ctx); err != nil {
+			if phase == phaseStart {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
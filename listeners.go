@@ -0,0 +1,355 @@
+package grouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+)
+
+// Endpoint is one of the addresses a server accepts connections on.
+type Endpoint struct {
+	// Network is "tcp" or "unix", it defaults to "tcp"
+	Network string
+	// Address to bind, e.g. "127.0.0.1:9090" or a socket path. It defaults to the HTTP(S) port.
+	Address string
+	// Listener is served instead of binding Address
+	Listener net.Listener
+	// Mode sets the permissions of a Unix socket when non-zero
+	Mode os.FileMode
+	// PlainHTTP serves without TLS even when the server has a TLSConfig, e.g. for a loopback admin port
+	PlainHTTP bool
+	// redirect marks the endpoint of a TLSConfig's RedirectConfig
+	redirect bool
+}
+
+// listenerGroup is the set of listeners a server serves together and shuts down together.
+type listenerGroup struct {
+	listeners []net.Listener
+	// names identify the listeners to a new process started by Restart
+	names   []string
+	servers []*http.Server
+}
+
+// ListenAll serves on every endpoint at once, sharing the router and lifecycle.
+// observer is closed once every endpoint is bound, no endpoint is served if one fails to bind.
+// observer is also closed when ListenAll fails before serving, its error then says why.
+// Shutdown drains all of them, and ListenAll returns once they have all stopped.
+// If one endpoint fails while serving, the others are shut down.
+func (instance *Server) ListenAll(observer chan struct{}, endpoints ...Endpoint) error {
+	if len(endpoints) == 0 {
+		return errors.New("grouter: no endpoints to listen on")
+	}
+	return instance.serveAll(endpoints, false, nil, observer)
+}
+
+// Addr returns the address of the server's first endpoint, or nil when it is not serving.
+func (instance *Server) Addr() net.Addr {
+	addrs := instance.Addrs()
+	if len(addrs) == 0 {
+		return nil
+	}
+	return addrs[0]
+}
+
+// Addrs returns the addresses the server accepts connections on, in the order they were given.
+func (instance *Server) Addrs() []net.Addr {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	if instance.listeners == nil {
+		return nil
+	}
+	addrs := make([]net.Addr, 0, len(instance.listeners.listeners))
+	for _, listener := range instance.listeners.listeners {
+		addrs = append(addrs, listener.Addr())
+	}
+	return addrs
+}
+
+// serveAll binds the endpoints that have no listener and serves all of them until the server shuts down.
+// starting is closed once the server is starting, from then on Shutdown stops it.
+func (instance *Server) serveAll(endpoints []Endpoint, requireTLS bool, starting chan struct{}, observer chan struct{}) error {
+	instance.mutex.Lock()
+	// Start tracing
+	c, span := instance.tracerProvider.Tracer(traceProviderName).Start(instance.context, "Listen")
+	// End tracing
+
+	listeners := make([]net.Listener, len(endpoints))
+	fail := func(err error) error {
+		instance.mutex.Unlock()
+		// Every listener is closed, whether it was given or bound here
+		for i, endpoint := range endpoints {
+			if endpoint.Listener != nil {
+				endpoint.Listener.Close()
+			} else if listeners[i] != nil {
+				listeners[i].Close()
+			}
+		}
+		span.RecordError(err)
+		span.End()
+		// Waiting callers are released, Listen's error tells them it did not start
+		if observer != nil {
+			close(observer)
+		}
+		return err
+	}
+	if instance.state != stateStopped {
+		return fail(ErrAlreadyServing)
+	}
+	tls := instance.tls
+	if requireTLS && tls == nil {
+		return fail(ErrTLSNotConfigured)
+	}
+	// Start hooks run unlocked, they may call back into the server
+	instance.state = stateStarting
+	instance.mutex.Unlock()
+	if starting != nil {
+		close(starting)
+	}
+	err := instance.runHooks(c, phaseStart)
+	instance.mutex.Lock()
+	// From here on a failure returns the server to stopped
+	stop := func() {
+		instance.state = stateStopped
+		instance.shutdownPending, instance.closePending = false, false
+	}
+	// A failure runs the stop hooks to release what the start hooks acquired, even when one of them failed
+	failStarting := func(err error) error {
+		stop()
+		ctx := instance.context
+		err = fail(err)
+		if stopErr := instance.runHooks(ctx, phaseStopped); stopErr != nil {
+			return errors.Join(err, stopErr)
+		}
+		return err
+	}
+	if err != nil || instance.shutdownPending {
+		if err == nil {
+			err = http.ErrServerClosed
+		}
+		closePending := instance.closePending
+		ctx := instance.context
+		err = failStarting(err)
+		if closePending {
+			if closeErr := instance.runHooks(ctx, phaseClose); closeErr != nil {
+				return errors.Join(err, closeErr)
+			}
+		}
+		return err
+	}
+	var certificates *certificateStore
+	if tls != nil {
+		if certificates, err = newCertificateStore(tls); err != nil {
+			return failStarting(err)
+		}
+	}
+	if tls != nil && tls.Redirect != nil && slices.ContainsFunc(endpoints, func(endpoint Endpoint) bool { return !endpoint.PlainHTTP }) {
+		// Clipped so that the caller's endpoints are not overwritten
+		endpoints = append(slices.Clip(endpoints), Endpoint{Address: tls.Redirect.Address, PlainHTTP: true, redirect: true})
+		listeners = append(listeners, nil)
+	}
+	for i, endpoint := range endpoints {
+		if endpoint.Listener != nil {
+			listeners[i] = endpoint.Listener
+			continue
+		}
+		listener, err := bind(endpoint, tls != nil && !endpoint.PlainHTTP)
+		if err != nil {
+			return failStarting(err)
+		}
+		listeners[i] = listener
+	}
+
+	instance.state = stateServing
+	group := &listenerGroup{listeners: listeners}
+	for i, listener := range listeners {
+		if endpoints[i].Listener != nil {
+			group.names = append(group.names, endpointName(listener.Addr().Network(), listener.Addr().String()))
+		} else {
+			group.names = append(group.names, endpointName(endpointAddress(endpoints[i], tls != nil && !endpoints[i].PlainHTTP)))
+		}
+		server := instance.newHTTPServer(instance.endpointHandler(tls, endpoints, listeners, i))
+		if certificates != nil && !endpoints[i].PlainHTTP {
+			server.TLSConfig = certificates.tlsConfig()
+		}
+		group.servers = append(group.servers, server)
+		instance.logger.InfoContext(c, "server listening", "address", listener.Addr().String(), "tls", tls != nil && !endpoints[i].PlainHTTP)
+	}
+	instance.listeners = group
+	instance.certificates = certificates
+	metrics := instance.metrics
+	ctx := instance.context
+	// Every listener is bound, close trace span and close any observers
+	instance.mutex.Unlock()
+	span.End()
+	if observer != nil {
+		close(observer)
+	}
+	readyErr := instance.runHooks(ctx, phaseReady)
+	if readyErr != nil {
+		instance.currentLogger().ErrorContext(ctx, "ready hook failed, shutting down the server", "error", readyErr)
+		go instance.Shutdown(true)
+	} else {
+		notifyReady()
+	}
+	metrics.listeners.Add(ctx, int64(len(listeners)))
+	defer metrics.listeners.Add(ctx, -int64(len(listeners)))
+	if certificates != nil {
+		stopWatching := make(chan struct{})
+		defer close(stopWatching)
+		go certificates.watch(ctx, instance.currentLogger(), stopWatching)
+	}
+
+	errs := make([]error, len(listeners))
+	var wg sync.WaitGroup
+	for i := range listeners {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if tls != nil && !endpoints[i].PlainHTTP {
+				// The certificate comes from the server's TLSConfig, so that Reload can replace it
+				errs[i] = group.servers[i].ServeTLS(listeners[i], "", "")
+			} else {
+				errs[i] = group.servers[i].Serve(listeners[i])
+			}
+			if errs[i] != http.ErrServerClosed {
+				// The endpoints share a lifecycle, so one failing stops the rest
+				instance.currentLogger().ErrorContext(ctx, "listener failed, shutting down the server", "address", listeners[i].Addr().String(), "error", errs[i])
+				instance.Shutdown(true)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// A concurrent Shutdown resets the state itself once connections have drained
+	instance.mutex.Lock()
+	if instance.state == stateServing && instance.listeners == group {
+		instance.state = stateStopped
+		instance.listeners = nil
+		instance.certificates = nil
+	}
+	instance.mutex.Unlock()
+	if readyErr != nil {
+		return readyErr
+	}
+	for _, err := range errs {
+		if err != http.ErrServerClosed {
+			return err
+		}
+	}
+	return http.ErrServerClosed
+}
+
+// endpointAddress returns the network and address endpoint binds, with the default port for useTLS.
+func endpointAddress(endpoint Endpoint, useTLS bool) (string, string) {
+	network := endpoint.Network
+	if network == "" {
+		network = "tcp"
+	}
+	address := endpoint.Address
+	if address == "" && network != "unix" {
+		address = ":http"
+		if useTLS {
+			address = ":https"
+		}
+	}
+	return network, address
+}
+
+// bind listens on endpoint's address, taking over the listener a previous process passed for it with Restart.
+func bind(endpoint Endpoint, useTLS bool) (net.Listener, error) {
+	network, address := endpointAddress(endpoint, useTLS)
+	if listener := claimInherited(network, address); listener != nil {
+		return listener, nil
+	}
+	switch network {
+	case "unix":
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("grouter: unsupported network %q", network)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" && endpoint.Mode != 0 {
+		if err := os.Chmod(address, endpoint.Mode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// endpointHandler returns the handler for endpoint i, which redirects or adds HSTS depending on tls.
+func (instance *Server) endpointHandler(tls *TLSConfig, endpoints []Endpoint, listeners []net.Listener, i int) http.Handler {
+	handler := http.Handler(http.HandlerFunc(instance.serveHTTP))
+	if tls == nil || tls.Redirect == nil {
+		return handler
+	}
+	if endpoints[i].redirect {
+		httpsPort := tls.Redirect.HTTPSPort
+		if httpsPort == 0 {
+			httpsPort = firstHTTPSPort(endpoints, listeners)
+		}
+		return tls.Redirect.redirectHandler(httpsPort, handler, instance.serveRedirect)
+	}
+	if header := tls.Redirect.hstsHeader(); header != "" && !endpoints[i].PlainHTTP {
+		return hstsHandler(header, handler)
+	}
+	return handler
+}
+
+// firstHTTPSPort returns the TCP port of the first endpoint served with TLS, or 443.
+func firstHTTPSPort(endpoints []Endpoint, listeners []net.Listener) int {
+	for i, endpoint := range endpoints {
+		if endpoint.PlainHTTP {
+			continue
+		}
+		if addr, ok := listeners[i].Addr().(*net.TCPAddr); ok {
+			return addr.Port
+		}
+	}
+	return 443
+}
+
+// newHTTPServer returns an http.Server for one endpoint, the caller holds the server's mutex.
+func (instance *Server) newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadTimeout:       instance.readTimeout,
+		ReadHeaderTimeout: instance.readHeaderTimeout,
+		WriteTimeout:      instance.writeTimeout,
+		IdleTimeout:       instance.idleTimeout,
+		MaxHeaderBytes:    instance.maxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(instance.logger.Handler(), slog.LevelError),
+		BaseContext: func(net.Listener) context.Context {
+			return instance.baseContext
+		},
+	}
+}
+
+// shutdown drains every server of the group concurrently.
+func (group *listenerGroup) shutdown(ctx context.Context) error {
+	errs := make([]error, len(group.servers))
+	var wg sync.WaitGroup
+	for i, server := range group.servers {
+		wg.Add(1)
+		go func(i int, server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil && err != http.ErrServerClosed {
+				errs[i] = err
+			}
+		}(i, server)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,81 @@
+package grouter
+
+import (
+	"context"
+	"log/slog"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	traceIDKey = "trace_id"
+	spanIDKey  = "span_id"
+)
+
+type loggerContextKey struct{}
+
+// traceHandler adds the trace and span ID of the active span to every record.
+type traceHandler struct {
+	handler slog.Handler
+	// Used when the record's context carries no span, e.g. for the request-scoped logger
+	spanContext trace.SpanContext
+}
+
+func (h traceHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h traceHandler) Handle(ctx context.Context, record slog.Record) error {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() {
+		spanContext = h.spanContext
+	}
+	if spanContext.IsValid() {
+		record.AddAttrs(
+			slog.String(traceIDKey, spanContext.TraceID().String()),
+			slog.String(spanIDKey, spanContext.SpanID().String()),
+		)
+	}
+	return h.handler.Handle(ctx, record)
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{handler: h.handler.WithAttrs(attrs), spanContext: h.spanContext}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{handler: h.handler.WithGroup(name), spanContext: h.spanContext}
+}
+
+// withTraceCorrelation returns a logger that adds trace_id and span_id to records logged with a span in their context.
+func withTraceCorrelation(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if _, ok := logger.Handler().(traceHandler); ok {
+		return logger
+	}
+	return slog.New(traceHandler{handler: logger.Handler()})
+}
+
+// requestLogger returns a logger correlated with span even when records are logged without a context.
+func requestLogger(logger *slog.Logger, span trace.Span) *slog.Logger {
+	handler := logger.Handler()
+	if correlated, ok := handler.(traceHandler); ok {
+		handler = correlated.handler
+	}
+	return slog.New(traceHandler{handler: handler, spanContext: span.SpanContext()})
+}
+
+// LoggerFromContext returns the request-scoped logger grouter passes to RequestHandlers,
+// or the default logger when ctx does not belong to a request.
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+func contextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
@@ -0,0 +1,122 @@
+package grouter
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const meterName = "grouter"
+
+type serverMetrics struct {
+	requestDuration  metric.Float64Histogram
+	activeRequests   metric.Int64UpDownCounter
+	requestBodySize  metric.Int64Histogram
+	responseBodySize metric.Int64Histogram
+	handlerErrors    metric.Int64Counter
+	handlerPanics    metric.Int64Counter
+	listeners        metric.Int64UpDownCounter
+}
+
+// newServerMetrics creates the request and lifecycle instruments on a meter from provider.
+func newServerMetrics(provider metric.MeterProvider) (*serverMetrics, error) {
+	meter := provider.Meter(meterName)
+	var err error
+	metrics := &serverMetrics{}
+
+	metrics.requestDuration, err = meter.Float64Histogram(
+		"http.server.request.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of HTTP server requests."),
+	)
+	if err != nil {
+		return nil, err
+	}
+	metrics.activeRequests, err = meter.Int64UpDownCounter(
+		"http.server.active_requests",
+		metric.WithUnit("{request}"),
+		metric.WithDescription("Number of active HTTP server requests."),
+	)
+	if err != nil {
+		return nil, err
+	}
+	metrics.requestBodySize, err = meter.Int64Histogram(
+		"http.server.request.body.size",
+		metric.WithUnit("By"),
+		metric.WithDescription("Size of HTTP server request bodies."),
+	)
+	if err != nil {
+		return nil, err
+	}
+	metrics.responseBodySize, err = meter.Int64Histogram(
+		"http.server.response.body.size",
+		metric.WithUnit("By"),
+		metric.WithDescription("Size of HTTP server response bodies."),
+	)
+	if err != nil {
+		return nil, err
+	}
+	metrics.handlerErrors, err = meter.Int64Counter(
+		"grouter.handler.errors",
+		metric.WithUnit("{error}"),
+		metric.WithDescription("Number of errors returned by request handlers."),
+	)
+	if err != nil {
+		return nil, err
+	}
+	metrics.handlerPanics, err = meter.Int64Counter(
+		"grouter.handler.panics",
+		metric.WithUnit("{panic}"),
+		metric.WithDescription("Number of panics recovered from request handlers."),
+	)
+	if err != nil {
+		return nil, err
+	}
+	metrics.listeners, err = meter.Int64UpDownCounter(
+		"grouter.server.listeners",
+		metric.WithUnit("{listener}"),
+		metric.WithDescription("Number of listeners currently serving requests."),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// otherMethod replaces methods grouter does not define in metric attributes, as in the HTTP semantic conventions,
+// so that clients cannot create series without limit.
+const otherMethod = "_OTHER"
+
+func metricMethod(method string) string {
+	switch HTTPMethod(method) {
+	case GET, POST, PUT, DELETE, PATCH, OPTIONS, HEAD:
+		return method
+	}
+	return otherMethod
+}
+
+// routeAttributes identifies the route a measurement belongs to, unmatched requests have no route.
+func routeAttributes(route string, r *http.Request) []attribute.KeyValue {
+	attributes := []attribute.KeyValue{attribute.String(requestMethodKey, metricMethod(r.Method))}
+	if route != "" {
+		attributes = append(attributes, attribute.String(routeKey, route))
+	}
+	return attributes
+}
+
+// recordRequest records the measurements taken once a request has been handled.
+func (metrics *serverMetrics) recordRequest(ctx context.Context, route string, r *http.Request, w *ResponseWriter, duration time.Duration) {
+	attributes := routeAttributes(route, r)
+	if w.StatusCode != nil {
+		attributes = append(attributes, attribute.Int(responseStatusCodeKey, *w.StatusCode))
+	}
+	options := metric.WithAttributes(attributes...)
+	metrics.requestDuration.Record(ctx, duration.Seconds(), options)
+	if r.ContentLength >= 0 {
+		metrics.requestBodySize.Record(ctx, r.ContentLength, options)
+	}
+	metrics.responseBodySize.Record(ctx, int64(w.BytesWritten), options)
+}
@@ -0,0 +1,229 @@
+package grouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServerOption configures a Server in NewServer.
+type ServerOption func(*Server) error
+
+// ErrorHandler writes the response for a request whose handler returned an error or panicked.
+type ErrorHandler func(context.Context, *ResponseWriter, *http.Request, error)
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+)
+
+// WithContext sets the context used for the server's management spans.
+func WithContext(ctx context.Context) ServerOption {
+	return func(instance *Server) error {
+		if ctx == nil {
+			return errors.New("grouter: nil context")
+		}
+		instance.context = ctx
+		if instance.router != nil {
+			instance.router.setContext(ctx)
+		}
+		return nil
+	}
+}
+
+// WithBaseContext sets the context every request context derives from, cancelling it stops in-flight handlers.
+func WithBaseContext(ctx context.Context) ServerOption {
+	return func(instance *Server) error {
+		if ctx == nil {
+			return errors.New("grouter: nil base context")
+		}
+		instance.baseContext = ctx
+		return nil
+	}
+}
+
+// WithAddress sets the TCP address ListenAndServe binds to, e.g. "127.0.0.1:8080".
+func WithAddress(address string) ServerOption {
+	return func(instance *Server) error {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("grouter: invalid address %q: %w", address, err)
+		}
+		instance.address = address
+		return nil
+	}
+}
+
+// WithTLSConfig serves HTTPS with the given certificate and key files.
+func WithTLSConfig(tls *TLSConfig) ServerOption {
+	return func(instance *Server) error {
+		if err := validateTLSConfig(tls); err != nil {
+			return err
+		}
+		instance.tls = tls
+		return nil
+	}
+}
+
+// WithRouter serves the routes of router instead of a new empty Router.
+func WithRouter(router *Router) ServerOption {
+	return func(instance *Server) error {
+		if router == nil {
+			return errors.New("grouter: nil router")
+		}
+		instance.router = router
+		return nil
+	}
+}
+
+// WithReadTimeout limits the time to read an entire request, including the body. Zero means no limit.
+func WithReadTimeout(timeout time.Duration) ServerOption {
+	return func(instance *Server) error {
+		if err := validateTimeout("read", timeout); err != nil {
+			return err
+		}
+		instance.readTimeout = timeout
+		return nil
+	}
+}
+
+// WithReadHeaderTimeout limits the time to read request headers, it defaults to 10 seconds. Zero means no limit.
+func WithReadHeaderTimeout(timeout time.Duration) ServerOption {
+	return func(instance *Server) error {
+		if err := validateTimeout("read header", timeout); err != nil {
+			return err
+		}
+		instance.readHeaderTimeout = timeout
+		return nil
+	}
+}
+
+// WithWriteTimeout limits the time from the end of reading the request headers to the end of the response.
+// Zero means no limit.
+func WithWriteTimeout(timeout time.Duration) ServerOption {
+	return func(instance *Server) error {
+		if err := validateTimeout("write", timeout); err != nil {
+			return err
+		}
+		instance.writeTimeout = timeout
+		return nil
+	}
+}
+
+// WithIdleTimeout limits how long keep-alive connections wait for the next request, it defaults to 2 minutes.
+// Zero means no limit.
+func WithIdleTimeout(timeout time.Duration) ServerOption {
+	return func(instance *Server) error {
+		if err := validateTimeout("idle", timeout); err != nil {
+			return err
+		}
+		instance.idleTimeout = timeout
+		return nil
+	}
+}
+
+// WithMaxHeaderBytes limits the size of request headers.
+func WithMaxHeaderBytes(n int) ServerOption {
+	return func(instance *Server) error {
+		if n <= 0 {
+			return fmt.Errorf("grouter: max header bytes must be positive, got %d", n)
+		}
+		instance.maxHeaderBytes = n
+		return nil
+	}
+}
+
+// WithDrainPeriod keeps serving for period after Shutdown is called while readiness reports unhealthy.
+func WithDrainPeriod(period time.Duration) ServerOption {
+	return func(instance *Server) error {
+		if err := validateTimeout("drain", period); err != nil {
+			return err
+		}
+		instance.drainPeriod = period
+		return nil
+	}
+}
+
+// WithShutdownTimeout limits how long Shutdown waits for in-flight requests before closing their connections,
+// it defaults to 30 seconds. Zero means no limit.
+func WithShutdownTimeout(timeout time.Duration) ServerOption {
+	return func(instance *Server) error {
+		if err := validateTimeout("shutdown", timeout); err != nil {
+			return err
+		}
+		instance.shutdownTimeout = timeout
+		return nil
+	}
+}
+
+// WithLogger replaces the logger of the server and its router.
+func WithLogger(logger *slog.Logger) ServerOption {
+	return func(instance *Server) error {
+		if logger == nil {
+			return errors.New("grouter: nil logger")
+		}
+		instance.logger = withTraceCorrelation(logger)
+		return nil
+	}
+}
+
+// WithTracerProvider sends the server's spans to provider instead of grouter's default trace files.
+func WithTracerProvider(provider trace.TracerProvider) ServerOption {
+	return func(instance *Server) error {
+		if provider == nil {
+			return errors.New("grouter: nil tracer provider")
+		}
+		instance.tracerProvider = provider
+		return nil
+	}
+}
+
+// WithResourceConfig describes the service in grouter's default trace files.
+func WithResourceConfig(config *ResourceConfig) ServerOption {
+	return func(instance *Server) error {
+		instance.resourceConfig = config
+		return nil
+	}
+}
+
+// WithMeterProvider sends the server's metrics to provider instead of the global MeterProvider.
+func WithMeterProvider(provider metric.MeterProvider) ServerOption {
+	return func(instance *Server) error {
+		if provider == nil {
+			return errors.New("grouter: nil meter provider")
+		}
+		instance.meterProvider = provider
+		return nil
+	}
+}
+
+// WithErrorHandler replaces the default 500 response for handlers that return an error or panic.
+func WithErrorHandler(handler ErrorHandler) ServerOption {
+	return func(instance *Server) error {
+		if handler == nil {
+			return errors.New("grouter: nil error handler")
+		}
+		instance.errorHandler = handler
+		return nil
+	}
+}
+
+func validateTimeout(name string, timeout time.Duration) error {
+	if timeout < 0 {
+		return fmt.Errorf("grouter: %s timeout must not be negative, got %s", name, timeout)
+	}
+	return nil
+}
+
+// defaultErrorHandler responds with 500 unless a response has already been started.
+func defaultErrorHandler(ctx context.Context, w *ResponseWriter, r *http.Request, err error) {
+	if w.StatusCode == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
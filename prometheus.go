@@ -0,0 +1,202 @@
+package grouter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Same buckets as the Prometheus client libraries use by default
+var prometheusDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type prometheusRouteKey struct {
+	route  string
+	method string
+}
+
+type prometheusRequestKey struct {
+	prometheusRouteKey
+	status string
+}
+
+type prometheusHistogram struct {
+	bucketCounts []uint64
+	count        uint64
+	sum          float64
+}
+
+// prometheusCollector aggregates request measurements for the Prometheus text exposition format.
+type prometheusCollector struct {
+	mutex     sync.Mutex
+	requests  map[prometheusRequestKey]uint64
+	durations map[prometheusRouteKey]*prometheusHistogram
+	inFlight  atomic.Int64
+}
+
+func newPrometheusCollector() *prometheusCollector {
+	return &prometheusCollector{
+		requests:  make(map[prometheusRequestKey]uint64),
+		durations: make(map[prometheusRouteKey]*prometheusHistogram),
+	}
+}
+
+// UseMetricsEndpoint serves request and Go runtime metrics in the Prometheus text format on path.
+// Requests are only measured once this has been called.
+func (instance *Server) UseMetricsEndpoint(path string) {
+	instance.mutex.Lock()
+	if instance.prometheus == nil {
+		instance.prometheus = newPrometheusCollector()
+	}
+	collector := instance.prometheus
+	instance.mutex.Unlock()
+	instance.Get(path, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		w.Header().Set("Content-Type", prometheusContentType)
+		w.WriteHeader(http.StatusOK)
+		return collector.write(w)
+	})
+}
+
+func (collector *prometheusCollector) observe(route string, r *http.Request, w *ResponseWriter, duration time.Duration) {
+	status := "0"
+	if w.StatusCode != nil {
+		status = strconv.Itoa(*w.StatusCode)
+	}
+	routeKey := prometheusRouteKey{route: route, method: metricMethod(r.Method)}
+
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	collector.requests[prometheusRequestKey{prometheusRouteKey: routeKey, status: status}]++
+	histogram, exists := collector.durations[routeKey]
+	if !exists {
+		histogram = &prometheusHistogram{bucketCounts: make([]uint64, len(prometheusDurationBuckets))}
+		collector.durations[routeKey] = histogram
+	}
+	seconds := duration.Seconds()
+	for i, bound := range prometheusDurationBuckets {
+		if seconds <= bound {
+			histogram.bucketCounts[i]++
+		}
+	}
+	histogram.count++
+	histogram.sum += seconds
+}
+
+// write renders every metric family in the text exposition format.
+func (collector *prometheusCollector) write(w io.Writer) error {
+	var buffer bytes.Buffer
+	collector.writeRequests(&buffer)
+	writeRuntimeMetrics(&buffer)
+	_, err := w.Write(buffer.Bytes())
+	return err
+}
+
+func (collector *prometheusCollector) writeRequests(buffer *bytes.Buffer) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	writeFamilyHeader(buffer, "grouter_http_requests_total", "counter", "Total number of HTTP requests by route template, method and status.")
+	requestKeys := make([]prometheusRequestKey, 0, len(collector.requests))
+	for key := range collector.requests {
+		requestKeys = append(requestKeys, key)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		if requestKeys[i].prometheusRouteKey != requestKeys[j].prometheusRouteKey {
+			return lessRouteKey(requestKeys[i].prometheusRouteKey, requestKeys[j].prometheusRouteKey)
+		}
+		return requestKeys[i].status < requestKeys[j].status
+	})
+	for _, key := range requestKeys {
+		writeSample(buffer, "grouter_http_requests_total", collector.requests[key], "route", key.route, "method", key.method, "status", key.status)
+	}
+
+	writeFamilyHeader(buffer, "grouter_http_request_duration_seconds", "histogram", "Duration of HTTP requests by route template and method.")
+	routeKeys := make([]prometheusRouteKey, 0, len(collector.durations))
+	for key := range collector.durations {
+		routeKeys = append(routeKeys, key)
+	}
+	sort.Slice(routeKeys, func(i, j int) bool {
+		return lessRouteKey(routeKeys[i], routeKeys[j])
+	})
+	for _, key := range routeKeys {
+		histogram := collector.durations[key]
+		for i, bound := range prometheusDurationBuckets {
+			writeSample(buffer, "grouter_http_request_duration_seconds_bucket", histogram.bucketCounts[i], "route", key.route, "method", key.method, "le", formatFloat(bound))
+		}
+		writeSample(buffer, "grouter_http_request_duration_seconds_bucket", histogram.count, "route", key.route, "method", key.method, "le", "+Inf")
+		writeSample(buffer, "grouter_http_request_duration_seconds_sum", histogram.sum, "route", key.route, "method", key.method)
+		writeSample(buffer, "grouter_http_request_duration_seconds_count", histogram.count, "route", key.route, "method", key.method)
+	}
+
+	writeFamilyHeader(buffer, "grouter_http_requests_in_flight", "gauge", "Number of HTTP requests currently being served.")
+	writeSample(buffer, "grouter_http_requests_in_flight", collector.inFlight.Load())
+}
+
+func writeRuntimeMetrics(buffer *bytes.Buffer) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	writeFamilyHeader(buffer, "go_info", "gauge", "Information about the Go environment.")
+	writeSample(buffer, "go_info", 1, "version", runtime.Version())
+	writeFamilyHeader(buffer, "go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	writeSample(buffer, "go_goroutines", runtime.NumGoroutine())
+	writeFamilyHeader(buffer, "go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.")
+	writeSample(buffer, "go_memstats_alloc_bytes", stats.Alloc)
+	writeFamilyHeader(buffer, "go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.")
+	writeSample(buffer, "go_memstats_heap_inuse_bytes", stats.HeapInuse)
+	writeFamilyHeader(buffer, "go_memstats_sys_bytes", "gauge", "Number of bytes obtained from the system.")
+	writeSample(buffer, "go_memstats_sys_bytes", stats.Sys)
+	writeFamilyHeader(buffer, "go_memstats_gc_cycles_total", "counter", "Number of completed GC cycles.")
+	writeSample(buffer, "go_memstats_gc_cycles_total", stats.NumGC)
+	writeFamilyHeader(buffer, "go_gc_pause_seconds_total", "counter", "Cumulative time spent in GC stop-the-world pauses.")
+	writeSample(buffer, "go_gc_pause_seconds_total", float64(stats.PauseTotalNs)/float64(time.Second))
+}
+
+func writeFamilyHeader(buffer *bytes.Buffer, name string, kind string, help string) {
+	fmt.Fprintf(buffer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeSample writes one sample line, labels are given as alternating names and values.
+func writeSample[N int | int64 | uint64 | uint32 | float64](buffer *bytes.Buffer, name string, value N, labels ...string) {
+	buffer.WriteString(name)
+	if len(labels) > 0 {
+		buffer.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			fmt.Fprintf(buffer, "%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1]))
+		}
+		buffer.WriteByte('}')
+	}
+	buffer.WriteByte(' ')
+	buffer.WriteString(formatFloat(float64(value)))
+	buffer.WriteByte('\n')
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func lessRouteKey(a prometheusRouteKey, b prometheusRouteKey) bool {
+	if a.route != b.route {
+		return a.route < b.route
+	}
+	return a.method < b.method
+}
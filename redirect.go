@@ -0,0 +1,104 @@
+package grouter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedirectConfig runs a plain HTTP endpoint next to the HTTPS ones that redirects every request to HTTPS.
+type RedirectConfig struct {
+	// Address of the plain HTTP endpoint, it defaults to ":http"
+	Address string
+	// HTTPSPort the redirects point to, it defaults to the port of the first HTTPS endpoint
+	HTTPSPort int
+	// HSTSMaxAge adds a Strict-Transport-Security header to HTTPS responses when positive
+	HSTSMaxAge time.Duration
+	// HSTSIncludeSubdomains extends the HSTS policy to every subdomain
+	HSTSIncludeSubdomains bool
+	// PlainPaths are served over plain HTTP instead of redirected, e.g. "/healthz"
+	PlainPaths []string
+}
+
+func validateRedirectConfig(redirect *RedirectConfig) error {
+	if redirect.Address != "" {
+		if _, _, err := net.SplitHostPort(redirect.Address); err != nil {
+			return fmt.Errorf("grouter: invalid redirect address %q: %w", redirect.Address, err)
+		}
+	}
+	if redirect.HTTPSPort < 0 || redirect.HTTPSPort > 65535 {
+		return fmt.Errorf("grouter: invalid redirect HTTPS port %d", redirect.HTTPSPort)
+	}
+	return nil
+}
+
+// hstsHeader returns the Strict-Transport-Security value, or "" when HSTS is off.
+func (redirect *RedirectConfig) hstsHeader() string {
+	if redirect.HSTSMaxAge <= 0 {
+		return ""
+	}
+	header := "max-age=" + strconv.Itoa(int(redirect.HSTSMaxAge/time.Second))
+	if redirect.HSTSIncludeSubdomains {
+		header += "; includeSubDomains"
+	}
+	return header
+}
+
+// redirectHandler answers the plain paths with next, and every other request with the 308 that serveRedirect serves.
+func (redirect *RedirectConfig) redirectHandler(httpsPort int, next http.Handler, serveRedirect func(http.Handler, http.ResponseWriter, *http.Request)) http.Handler {
+	plainPaths := make(map[string]struct{}, len(redirect.PlainPaths))
+	for _, path := range redirect.PlainPaths {
+		plainPaths[path] = struct{}{}
+	}
+	toHTTPS := httpsRedirect(httpsPort)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, plain := plainPaths[r.URL.Path]; plain {
+			next.ServeHTTP(w, r)
+			return
+		}
+		serveRedirect(toHTTPS, w, r)
+	})
+}
+
+// httpsRedirect answers with a 308 to the same URL over HTTPS on httpsPort.
+// A request without a Host header is redirected to the address it was received on.
+func httpsRedirect(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if host == "" {
+			// HTTP/1.0 requests may omit Host, the address they reached is the best guess
+			if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+				host = addr.String()
+			}
+		}
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		} else {
+			// A bare IPv6 host keeps its brackets, e.g. "[::1]"
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+		if host == "" {
+			http.Error(w, "missing Host header", http.StatusBadRequest)
+			return
+		}
+		// net.JoinHostPort brackets IPv6 addresses
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		} else if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			host = "[" + host + "]"
+		}
+		// 308 keeps the method and body, unlike 301
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// hstsHandler adds the Strict-Transport-Security header to every response of next.
+func hstsHandler(header string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", header)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -7,17 +7,26 @@ import (
 type ResponseWriter struct {
 	responseWriter http.ResponseWriter
 	StatusCode     *int
+	BytesWritten   int
 }
 
 func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
 	return &ResponseWriter{
 		responseWriter: w,
 		StatusCode:     nil,
+		BytesWritten:   0,
 	}
 }
 
 func (w *ResponseWriter) Write(p []byte) (n int, err error) {
-	return w.responseWriter.Write(p)
+	// Writing the body without a header implicitly sends 200 OK
+	if w.StatusCode == nil {
+		statusCode := http.StatusOK
+		w.StatusCode = &statusCode
+	}
+	n, err = w.responseWriter.Write(p)
+	w.BytesWritten += n
+	return n, err
 }
 
 func (w *ResponseWriter) WriteHeader(statusCode int) {
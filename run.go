@@ -0,0 +1,90 @@
+package grouter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Run serves on endpoints, or on the address set with WithAddress, until SIGINT or SIGTERM is received
+// or ctx is cancelled, then shuts the server down gracefully. SIGHUP calls Reload.
+// It returns nil after a graceful shutdown, and the error that stopped the server otherwise.
+func (instance *Server) Run(ctx context.Context, endpoints ...Endpoint) error {
+	if len(endpoints) == 0 {
+		endpoints = []Endpoint{{Address: instance.address}}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	starting, served := make(chan struct{}), make(chan error, 1)
+	go func() {
+		served <- instance.serveAll(endpoints, false, starting, nil)
+	}()
+	for {
+		select {
+		case err := <-served:
+			return stoppedRun(err)
+		case received := <-signals:
+			if received == syscall.SIGHUP {
+				if err := instance.Reload(); err != nil {
+					instance.currentLogger().ErrorContext(ctx, "reload failed", "error", err)
+				}
+				continue
+			}
+			instance.currentLogger().InfoContext(ctx, "received signal, shutting down", "signal", received.String())
+		case <-ctx.Done():
+		}
+		// Shutdown ignores a server that is not starting yet
+		select {
+		case <-starting:
+		case err := <-served:
+			return stoppedRun(err)
+		}
+		err := instance.Shutdown(false)
+		if servedErr := <-served; servedErr != http.ErrServerClosed {
+			err = errors.Join(err, servedErr)
+		}
+		return err
+	}
+}
+
+// stoppedRun is the result of Run for a server that stopped without Run shutting it down,
+// e.g. by a failing listener or a call to Shutdown.
+func stoppedRun(err error) error {
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Reload loads the TLS certificate and key files again and runs the reload hooks.
+// New connections use the new certificates, the current ones are kept if any file cannot be loaded.
+func (instance *Server) Reload() error {
+	instance.mutex.RLock()
+	// Start tracing
+	c, span := instance.tracerProvider.Tracer(traceProviderName).Start(instance.context, "Reload")
+	defer span.End()
+	// End tracing
+	certificates := instance.certificates
+	logger := instance.logger
+	instance.mutex.RUnlock()
+
+	var errs []error
+	if certificates != nil {
+		if err := certificates.reload(); err != nil {
+			errs = append(errs, err)
+		} else {
+			logger.InfoContext(c, "reloaded TLS certificates", "cert_files", certificates.config.Load().certFiles())
+		}
+	}
+	errs = append(errs, instance.runHooks(c, phaseReload))
+	if err := errors.Join(errs...); err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
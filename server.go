@@ -2,118 +2,287 @@ package grouter
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 )
 
-var _instance *Server
-var once sync.Once
-
 type TLSConfig struct {
+	// CertFilePath and KeyFilePath are the default pair, served when no pair of Certificates is for the requested server name
+	CertFilePath string
+	KeyFilePath  string
+	// Certificates are selected by the server name clients send (SNI). Without a default pair, the first one is the default
+	Certificates []CertificatePair
+	// ClientCAFilePath is a PEM bundle of the CAs that client certificates are verified against
+	ClientCAFilePath string
+	// ClientAuth asks clients for a certificate, see ClientIdentityFromRequest and RequireClientIdentity
+	ClientAuth ClientAuthMode
+	// Redirect runs a plain HTTP endpoint that redirects to HTTPS when set
+	Redirect *RedirectConfig
+	// ReloadInterval is how often the files are checked for changes while serving, so that rotated certificates
+	// are used without Reload. Zero checks every minute, a negative interval disables the check.
+	ReloadInterval time.Duration
+}
+
+// CertificatePair is a certificate and key served for some server names.
+type CertificatePair struct {
+	// ServerNames are host names such as "example.com" or wildcards such as "*.example.com" matching one label.
+	// The DNS names of the certificate are used when empty
+	ServerNames  []string
 	CertFilePath string
 	KeyFilePath  string
 }
 
+// pairs returns the default pair, if set, followed by Certificates.
+func (config *TLSConfig) pairs() []CertificatePair {
+	pairs := []CertificatePair{}
+	if config.CertFilePath != "" || config.KeyFilePath != "" {
+		pairs = append(pairs, CertificatePair{CertFilePath: config.CertFilePath, KeyFilePath: config.KeyFilePath})
+	}
+	return append(pairs, config.Certificates...)
+}
+
+func (config *TLSConfig) certFiles() []string {
+	files := []string{}
+	for _, pair := range config.pairs() {
+		files = append(files, pair.CertFilePath)
+	}
+	return files
+}
+
+type serverState int
+
+const (
+	stateStopped serverState = iota
+	// The start hooks are running, the endpoints are not bound yet
+	stateStarting
+	stateServing
+	stateShuttingDown
+)
+
+// Server is safe for concurrent use, the mutex guards its lifecycle state and everything its setters replace.
 type Server struct {
+	mutex sync.RWMutex
+	state serverState
+	// shutdownPending records a Shutdown called while the start hooks run, the server stops once they finish
+	shutdownPending   bool
+	closePending      bool
 	router            *Router
 	tls               *TLSConfig
-	httpServer        *http.Server
-	serving           bool
-	shuttingDown      bool
+	address           string
+	listeners         *listenerGroup
+	certificates      *certificateStore
 	context           context.Context
-	additionalCleanup []func(context.Context) error
+	baseContext       context.Context
+	readTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+	drainPeriod       time.Duration
+	shutdownTimeout   time.Duration
+	hooks             map[lifecyclePhase][]LifecycleHook
+	inFlight          atomic.Int64
+	errorHandler      ErrorHandler
+	logger            *slog.Logger
+	tracerProvider    trace.TracerProvider
+	resourceConfig    *ResourceConfig
+	meterProvider     metric.MeterProvider
+	metrics           *serverMetrics
+	prometheus        *prometheusCollector
+	accessLogger      *AccessLogger
 }
 
-func setup() []func(context.Context) error {
+func setup(resourceConfig *ResourceConfig) (trace.TracerProvider, []LifecycleHook, error) {
 	// Tracing
-	tracingCleanup, err := startTracing()
+	tracerProvider, tracingCleanup, err := startTracing(resourceConfig)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
-	return []func(context.Context) error{
+	return tracerProvider, []LifecycleHook{
 		tracingCleanup,
-	}
+	}, nil
 }
 
-func GetServer(ctx *context.Context, tls *TLSConfig) *Server {
-	once.Do(func() {
-		additionalCleanup := setup()
-		_instance = &Server{
-			router:            NewRouter(*ctx),
-			tls:               tls,
-			httpServer:        nil,
-			serving:           false,
-			shuttingDown:      false,
-			context:           *ctx,
-			additionalCleanup: additionalCleanup,
+// NewServer returns an independent Server, options are applied in order.
+func NewServer(options ...ServerOption) (*Server, error) {
+	instance := &Server{
+		router:            nil,
+		tls:               nil,
+		address:           "",
+		listeners:         nil,
+		state:             stateStopped,
+		context:           context.Background(),
+		baseContext:       context.Background(),
+		readHeaderTimeout: defaultReadHeaderTimeout,
+		idleTimeout:       defaultIdleTimeout,
+		shutdownTimeout:   defaultShutdownTimeout,
+		errorHandler:      defaultErrorHandler,
+		logger:            withTraceCorrelation(slog.Default()),
+		meterProvider:     otel.GetMeterProvider(),
+		hooks:             make(map[lifecyclePhase][]LifecycleHook),
+	}
+	for _, option := range options {
+		if err := option(instance); err != nil {
+			return nil, err
 		}
-		// If the context is nil, create a new one with the default background context
-		if _instance.context == nil {
-			_instance.SetTracingContext(context.Background())
+	}
+	if instance.router == nil {
+		instance.router = NewRouter(instance.context)
+	}
+
+	var err error
+	// Without a tracer provider, write traces to grouter's default trace files
+	if instance.tracerProvider == nil {
+		instance.tracerProvider, instance.hooks[phaseClose], err = setup(instance.resourceConfig)
+		if err != nil {
+			return nil, err
 		}
-	})
-	// When testing the server, we need to be able to change the TLS config on the fly
-	if _instance.tls != tls {
-		return _instance.SetTLSConfig(tls)
 	}
-	return _instance
+	instance.router.setTracerProvider(instance.tracerProvider)
+	instance.router.SetLogger(instance.logger)
+	instance.metrics, err = newServerMetrics(instance.meterProvider)
+	if err != nil {
+		return nil, err
+	}
+	return instance, nil
 }
 
 func (instance *Server) SetTracingContext(ctx context.Context) *Server {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
 	instance.context = ctx
-	instance.router.context = ctx
+	instance.router.setContext(ctx)
 	return instance
 }
 
-func (instance *Server) SetRouter(router *Router) *Server {
-	if instance.router == router {
-		return instance
-	}
-	if instance.serving {
-		fmt.Println("Changing the router while the server is running is not supported, shuting down the server...")
-		err := instance.Shutdown(true)
-		if err != nil {
-			log.Fatal(err)
+// SetLogger replaces the logger of the server and its router.
+// Records carry the trace_id and span_id of the span in their context.
+func (instance *Server) SetLogger(logger *slog.Logger) *Server {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.logger = withTraceCorrelation(logger)
+	instance.router.SetLogger(logger)
+	return instance
+}
+
+// SetResourceConfig restarts grouter's default tracing so that new spans are attributed to the configured service.
+// It replaces a tracer provider set with WithTracerProvider.
+func (instance *Server) SetResourceConfig(config *ResourceConfig) error {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	for _, cleanup := range instance.hooks[phaseClose] {
+		if err := cleanup(instance.context); err != nil {
+			return err
 		}
 	}
-	instance.router = router
-	return instance
+	tracerProvider, cleanups, err := setup(config)
+	if err != nil {
+		return err
+	}
+	instance.hooks[phaseClose] = cleanups
+	instance.resourceConfig = config
+	instance.tracerProvider = tracerProvider
+	instance.router.setTracerProvider(instance.tracerProvider)
+	return nil
 }
 
-func (instance *Server) SetTLSConfig(tls *TLSConfig) *Server {
-	if instance.tls == tls {
-		return instance
+// SetMeterProvider sends the server's metrics to provider instead of the global MeterProvider.
+func (instance *Server) SetMeterProvider(provider metric.MeterProvider) error {
+	metrics, err := newServerMetrics(provider)
+	if err != nil {
+		return err
 	}
-	if instance.serving {
-		fmt.Println("Changing the TLS config while the server is running is not supported, shuting down the server...")
-		err := instance.Shutdown(true)
-		if err != nil {
-			log.Fatal(err)
-		}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.meterProvider = provider
+	instance.metrics = metrics
+	return nil
+}
+
+// SetRouter replaces the router, a running server keeps its connections and serves new requests with router.
+func (instance *Server) SetRouter(router *Router) error {
+	if router == nil {
+		return errors.New("grouter: nil router")
 	}
-	if err := validatePath(tls.CertFilePath); err != nil {
-		log.Fatal(err)
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	router.setTracerProvider(instance.tracerProvider)
+	instance.router = router
+	return nil
+}
+
+// SetTLSConfig replaces the TLS config, a nil config switches to plain HTTP.
+// It fails with ErrInvalidTLSFiles when the files cannot be used.
+// A server serving HTTPS switches to the new certificate for new connections without dropping any,
+// its redirect endpoint changes on the next Listen. Switching between HTTP and HTTPS shuts a running server down.
+func (instance *Server) SetTLSConfig(tls *TLSConfig) error {
+	instance.mutex.RLock()
+	unchanged := instance.tls == tls
+	certificates := instance.certificates
+	hot := instance.state == stateServing && certificates != nil && tls != nil
+	instance.mutex.RUnlock()
+	if unchanged {
+		return nil
 	}
-	if err := validatePath(tls.KeyFilePath); err != nil {
-		log.Fatal(err)
+	if err := validateTLSConfig(tls); err != nil {
+		return err
 	}
+	if hot {
+		if err := certificates.replace(tls); err != nil {
+			return err
+		}
+	} else if instance.isServing() {
+		instance.currentLogger().Warn("switching between HTTP and HTTPS while the server is running is not supported, shutting down the server")
+		if err := instance.Shutdown(true); err != nil {
+			return err
+		}
+	}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
 	instance.tls = tls
-	return instance
+	return nil
 }
 
-func (instance *Server) UseGlobal(handler RequestHandler, options *GlobalRouteOptions) {
-	instance.router.UseGlobal(handler, options)
+func (instance *Server) UseGlobal(handler RequestHandler, options *GlobalRouteOptions) error {
+	return instance.currentRouter().UseGlobal(handler, options)
+}
+
+func (instance *Server) UseGlobalNamed(name string, handler RequestHandler, options *GlobalRouteOptions) error {
+	return instance.currentRouter().UseGlobalNamed(name, handler, options)
 }
 
 func (instance *Server) Use(path string, method HTTPMethod, handler RequestHandler) {
-	instance.router.Use(path, method, handler)
+	instance.currentRouter().Use(path, method, handler)
+}
+
+func (instance *Server) UseNamed(path string, method HTTPMethod, name string, handler RequestHandler) {
+	instance.currentRouter().UseNamed(path, method, name, handler)
+}
+
+func (instance *Server) Handle(path string, method HTTPMethod, handler RequestHandler) error {
+	return instance.currentRouter().Handle(path, method, handler)
+}
+
+func (instance *Server) Replace(path string, method HTTPMethod, handlers ...RequestHandler) {
+	instance.currentRouter().Replace(path, method, handlers...)
+}
+
+func (instance *Server) Remove(path string, method HTTPMethod) bool {
+	return instance.currentRouter().Remove(path, method)
 }
 
 func (instance *Server) Get(path string, handler RequestHandler) {
@@ -144,128 +313,285 @@ func (instance *Server) Head(path string, handler RequestHandler) {
 	instance.Use(path, HEAD, handler)
 }
 
+// Listen serves on the given port of every interface, a port of 0 picks a free one that Addr reports.
+// observer is closed once the port is bound and the server is about to accept connections,
+// or when Listen fails before serving.
 func (instance *Server) Listen(port int, observer chan struct{}) error {
-	// Start tracing
-	_, span := otel.Tracer(traceProviderName).Start(instance.context, "Listen")
-	// End tracing
+	return instance.serveAll([]Endpoint{{Address: fmt.Sprintf(":%d", port)}}, false, nil, observer)
+}
 
-	if instance.serving {
-		log.Fatal("Server is already running, called Listen() twice")
-	}
-	instance.serving = true
-	mux := http.NewServeMux()
-	for path := range instance.router.paths {
-		localPath := path // Create a local copy of the path variable
-		mux.HandleFunc(localPath, func(w http.ResponseWriter, r *http.Request) {
-			// Create a span for the request trace
-			c, requestSpan := otel.Tracer(traceProviderName).Start(
-				context.Background(), // New context because the request traces should be separate from the server management trace
-				fmt.Sprintf("%s %s", r.Method, r.URL.Path),
-				trace.WithAttributes(
-					attribute.Bool("tls", instance.tls != nil),
-					attribute.String("http.request.method", r.Method),
-					attribute.Int("http.request.body.size", int(r.ContentLength)),
-				),
-			)
-
-			wrapper := NewResponseWriter(w)
-			instance.runHandlersForPath(c, localPath, wrapper, r)
-
-			// If the response is 1xx, 2xx, or 3xx, set the span status to Error
-			if wrapper.StatusCode != nil {
-				requestSpan.SetAttributes(attribute.Int("http.response.status_code", *wrapper.StatusCode))
-			}
-			if *wrapper.StatusCode >= 500 {
-				requestSpan.SetStatus(2, "HTTP status code >= 500") // 2 = OLTP Error
-			}
-			requestSpan.End()
-		})
-	}
-	// Convert the port number to a string and prepend the colon
-	portStr := fmt.Sprintf(":%d", port)
-	// Start the HTTP(s) server on the specified port
-	instance.httpServer = &http.Server{
-		Addr:    portStr,
-		Handler: mux,
-	}
-	// Server is about to start listening, close trace span and close any observers
-	span.End()
-	close(observer)
-	var err error
-	if instance.tls != nil {
-		err = instance.httpServer.ListenAndServeTLS(instance.tls.CertFilePath, instance.tls.KeyFilePath)
-	} else {
-		err = instance.httpServer.ListenAndServe()
-	}
-	instance.serving = false
-	return err
+// ListenAndServe serves on the address set with WithAddress, or on the default HTTP(S) port.
+func (instance *Server) ListenAndServe(observer chan struct{}) error {
+	return instance.serveAll([]Endpoint{{Address: instance.address}}, false, nil, observer)
+}
+
+// Serve accepts connections on listener, with TLS when a TLSConfig is set. listener is closed when Serve returns.
+func (instance *Server) Serve(listener net.Listener) error {
+	return instance.serveAll([]Endpoint{{Listener: listener}}, false, nil, nil)
+}
+
+// ServeTLS is Serve that fails with ErrTLSNotConfigured instead of serving plain HTTP when no TLSConfig is set.
+func (instance *Server) ServeTLS(listener net.Listener) error {
+	return instance.serveAll([]Endpoint{{Listener: listener}}, true, nil, nil)
 }
 
+// Shutdown stops the server in phases: readiness reports unhealthy for the drain period while requests are still served,
+// then the listeners close and in-flight requests get up to the shutdown timeout to finish,
+// then the remaining connections are closed and a ShutdownTimeoutError reports the requests that were cut off.
+// Unless willRestart is set, grouter's default tracing is shut down afterwards.
 func (instance *Server) Shutdown(willRestart bool) error {
+	instance.mutex.Lock()
 	// Start tracing
-	c, span := otel.Tracer(traceProviderName).Start(instance.context, "Shutdown")
+	c, span := instance.tracerProvider.Tracer(traceProviderName).Start(instance.context, "Shutdown")
+	defer span.End()
+	// End tracing
+	logger := instance.logger
 
-	if !instance.serving {
-		fmt.Println("Server is not running, called Shutdown() on a stopped server")
-		span.End()
+	switch instance.state {
+	case stateStopped:
+		instance.mutex.Unlock()
+		logger.WarnContext(c, "server is not running, called Shutdown() on a stopped server")
 		return nil
-	}
-	if instance.shuttingDown {
-		fmt.Println("Server is already shutting down, called Shutdown() twice")
-		span.End()
+	case stateStarting:
+		// The endpoints are not bound yet, the server stops instead of binding them once the start hooks finish
+		instance.shutdownPending = true
+		instance.closePending = instance.closePending || !willRestart
+		instance.mutex.Unlock()
+		logger.InfoContext(c, "server is starting, it will stop once the start hooks finish")
+		return nil
+	case stateShuttingDown:
+		instance.mutex.Unlock()
+		logger.WarnContext(c, "server is already shutting down, called Shutdown() twice")
 		return nil
 	}
-	instance.shuttingDown = true
-	if instance.httpServer != nil {
-		fmt.Println("...Shutting down server...")
-		err := instance.httpServer.Shutdown(c)
-		if err != nil && err != http.ErrServerClosed {
-			span.End()
-			return err
+	instance.state = stateShuttingDown
+	group := instance.listeners
+	drainPeriod, shutdownTimeout := instance.drainPeriod, instance.shutdownTimeout
+	instance.mutex.Unlock()
+
+	// Drain outside the lock so that in-flight requests can still read the server's configuration
+	errs := []error{instance.runHooks(c, phaseDraining)}
+	logger.InfoContext(c, "draining server", "drain_period", drainPeriod)
+	drain(c, drainPeriod)
+
+	errs = append(errs, instance.runHooks(c, phaseGraceful))
+	logger.InfoContext(c, "shutting down server", "timeout", shutdownTimeout)
+	shutdownContext, cancel := c, context.CancelFunc(func() {})
+	if shutdownTimeout > 0 {
+		shutdownContext, cancel = context.WithTimeout(c, shutdownTimeout)
+	}
+	err := group.shutdown(shutdownContext)
+	timedOut := err != nil && shutdownContext.Err() != nil
+	cancel()
+	if timedOut {
+		errs = append(errs, instance.runHooks(c, phaseForced))
+		interrupted := instance.inFlight.Load()
+		logger.WarnContext(c, "shutdown timed out, closing connections", "interrupted_requests", interrupted)
+		span.SetAttributes(attribute.Int64(interruptedRequestsKey, interrupted))
+		if closeErr := group.close(); closeErr != nil {
+			errs = append(errs, closeErr)
 		}
+		err = &ShutdownTimeoutError{Interrupted: interrupted}
 	}
-	instance.shuttingDown = false
-	span.End()
+	errs = append(errs, err)
+
+	instance.mutex.Lock()
+	instance.state = stateStopped
+	instance.listeners = nil
+	instance.certificates = nil
+	ctx := instance.context
+	instance.mutex.Unlock()
+	errs = append(errs, instance.runHooks(c, phaseStopped))
 	if !willRestart {
-		// If the server is not going to be restarted, run any additional cleanup functions
-		for _, cleanup := range instance.additionalCleanup {
-			err := cleanup(instance.context)
-			if err != nil {
-				return err
-			}
-		}
+		// If the server is not going to be restarted, release grouter's own resources last
+		errs = append(errs, instance.runHooks(ctx, phaseClose))
+	}
+	if err := errors.Join(errs...); err != nil {
+		span.RecordError(err)
+		return err
 	}
 	return nil
 }
 
-func (instance *Server) runHandlersForPath(ctx context.Context, path string, w *ResponseWriter, r *http.Request) {
+func (instance *Server) tracer() trace.Tracer {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	return instance.tracerProvider.Tracer(traceProviderName)
+}
+
+func (instance *Server) isServing() bool {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	return instance.state != stateStopped
+}
+
+func (instance *Server) currentRouter() *Router {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	return instance.router
+}
+
+func (instance *Server) currentLogger() *slog.Logger {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	return instance.logger
+}
+
+func (instance *Server) currentMetrics() *serverMetrics {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	return instance.metrics
+}
+
+// serveHTTP routes r with the router's current table, the request keeps using that table even if the routes change.
+func (instance *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	instance.inFlight.Add(1)
+	defer instance.inFlight.Add(-1)
+	table := instance.currentRouter().routes()
+	path, redirect := table.match(r)
+	instance.handleRequest(table, path, redirect, w, r)
+}
+
+// serveRedirect answers a request with redirect instead of the routes, traced, measured and logged like them.
+func (instance *Server) serveRedirect(redirect http.Handler, w http.ResponseWriter, r *http.Request) {
+	instance.inFlight.Add(1)
+	defer instance.inFlight.Add(-1)
+	instance.handleRequest(instance.currentRouter().routes(), "", redirect, w, r)
+}
+
+// handleRequest serves a request matched to the route template path, an empty path serves unmatched requests.
+// A non-nil redirect answers the request instead of the handlers, e.g. net/http's redirect from "/docs" to "/docs/"
+// or the redirect endpoint's redirect to HTTPS.
+func (instance *Server) handleRequest(table *routeTable, path string, redirect http.Handler, w http.ResponseWriter, r *http.Request) {
+	spanName := r.Method
+	if path != "" {
+		spanName = fmt.Sprintf("%s %s", r.Method, path)
+	}
+	// Read everything a setter may replace once, so that the request sees a consistent configuration
+	instance.mutex.RLock()
+	metrics := instance.metrics
+	collector := instance.prometheus
+	accessLogger := instance.accessLogger
+	logger := instance.logger
+	instance.mutex.RUnlock()
+
+	// Create a span for the request trace, named by the route template to keep cardinality low
+	c, requestSpan := instance.tracer().Start(
+		r.Context(),
+		spanName,
+		trace.WithNewRoot(), // New root because the request traces should be separate from the server management trace
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.Bool("tls", r.TLS != nil)),
+		trace.WithAttributes(requestAttributes(path, r)...),
+	)
+
+	start := time.Now()
+	activeAttributes := metric.WithAttributes(routeAttributes(path, r)...)
+	metrics.activeRequests.Add(c, 1, activeAttributes)
+	defer metrics.activeRequests.Add(c, -1, activeAttributes)
+
+	if collector != nil {
+		collector.inFlight.Add(1)
+		defer collector.inFlight.Add(-1)
+	}
+
+	// Handlers get a logger correlated with the request span through their context
+	logger = requestLogger(logger, requestSpan).With(
+		slog.String(requestMethodKey, r.Method),
+		slog.String(urlPathKey, r.URL.Path),
+	)
+	c = contextWithLogger(c, logger)
+
+	wrapper := NewResponseWriter(w)
+	if redirect != nil {
+		// The redirect event is added with the response status below
+		redirect.ServeHTTP(wrapper, r)
+	} else if path == "" {
+		requestSpan.AddEvent(routeNotFoundEvent)
+		wrapper.WriteHeader(http.StatusNotFound)
+	} else {
+		instance.runHandlersRecovering(c, table, path, wrapper, r)
+	}
+	duration := time.Since(start)
+	metrics.recordRequest(c, path, r, wrapper, duration)
+	if collector != nil {
+		collector.observe(path, r, wrapper, duration)
+	}
+	if accessLogger != nil {
+		if err := accessLogger.log(start, path, r, wrapper, duration); err != nil {
+			logger.WarnContext(c, "failed to write access log", "error", err)
+		}
+	}
+
+	requestSpan.SetAttributes(attribute.Int(responseBodySizeKey, wrapper.BytesWritten))
+	if wrapper.StatusCode != nil {
+		requestSpan.SetAttributes(attribute.Int(responseStatusCodeKey, *wrapper.StatusCode))
+		// Only 5xx responses mark the server span as failed
+		if *wrapper.StatusCode >= 500 {
+			requestSpan.SetStatus(codes.Error, "HTTP status code >= 500")
+		}
+		if *wrapper.StatusCode >= 300 && *wrapper.StatusCode < 400 {
+			requestSpan.AddEvent(routeRedirectEvent, trace.WithAttributes(
+				attribute.Int(responseStatusCodeKey, *wrapper.StatusCode),
+				attribute.String(redirectLocationKey, wrapper.Header().Get("Location")),
+			))
+		}
+	}
+	requestSpan.End()
+}
+
+// runHandlersRecovering runs the handlers for path, turning a panic into a 500 response.
+func (instance *Server) runHandlersRecovering(ctx context.Context, table *routeTable, path string, w *ResponseWriter, r *http.Request) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		// net/http uses this panic to abort the response on purpose
+		if recovered == http.ErrAbortHandler {
+			panic(recovered)
+		}
+		instance.currentMetrics().handlerPanics.Add(ctx, 1, metric.WithAttributes(routeAttributes(path, r)...))
+		recordPanic(trace.SpanFromContext(ctx), recovered)
+		LoggerFromContext(ctx).ErrorContext(ctx, "handler panicked", "panic", recovered, "route", path)
+		instance.errorHandler(ctx, w, r, fmt.Errorf("panic: %v", recovered))
+	}()
+	instance.runHandlersForPath(ctx, table, path, w, r)
+}
+
+func (instance *Server) runHandlersForPath(ctx context.Context, table *routeTable, path string, w *ResponseWriter, r *http.Request) {
+	requestSpan := trace.SpanFromContext(ctx)
 	// Start tracing
-	c, span := otel.Tracer(traceProviderName).Start(ctx, "runHandlersForPath")
+	c, span := instance.tracer().Start(ctx, "runHandlersForPath")
 	defer span.End()
 	// End tracing
 
 	// Run global handlers before the route handlers
-	err := instance.runGlobalHandlers(c, path, w, r, true)
+	err := instance.runGlobalHandlers(c, table, path, w, r, true)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Printf("GlobalHandlers:Before:Error: %v", err)
+		recordError(requestSpan, err)
 		return
 	}
 	// Get the route for the path and method
-	route := instance.router.trie.Get(path)
-	if route == nil || route.(Route)[HTTPMethod(r.Method)] == nil || len(route.(Route)[HTTPMethod(r.Method)]) == 0 {
+	handlers, allowed := table.handlers(path, HTTPMethod(r.Method))
+	if allowed == nil {
+		requestSpan.AddEvent(routeNotFoundEvent)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if len(handlers) == 0 {
+		requestSpan.AddEvent(routeMethodNotAllowedEvent, trace.WithAttributes(attribute.StringSlice(allowedMethodsKey, allowed)))
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 	// Run the route handlers
-	nextCalled := false
-	for _, handler := range route.(Route)[HTTPMethod(r.Method)] {
-		err := handler(c, w, r, func() {
-			nextCalled = true
-		})
+	for _, handler := range handlers {
+		nextCalled, err := instance.runHandler(c, routeHandlerKind, handler.name, handler.handler, w, r)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Printf("RouteHandlers:Error: %v", err)
+			instance.currentMetrics().handlerErrors.Add(c, 1, metric.WithAttributes(routeAttributes(path, r)...))
+			recordError(requestSpan, err)
+			instance.errorHandler(c, w, r, err)
+			LoggerFromContext(ctx).ErrorContext(ctx, "route handler failed", "error", err, "route", path, "handler", handler.name)
 			return
 		}
 		if !nextCalled {
@@ -273,33 +599,30 @@ func (instance *Server) runHandlersForPath(ctx context.Context, path string, w *
 		}
 	}
 	// Run global handlers after the route handlers
-	err = instance.runGlobalHandlers(c, path, w, r, false)
+	err = instance.runGlobalHandlers(c, table, path, w, r, false)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Printf("GlobalHandlers:After:Error %v", err)
+		recordError(requestSpan, err)
 		return
 	}
 	// If no response was sent, send a default response
 	if w.StatusCode == nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Printf("Error: Server did not send response for path %s", path)
+		LoggerFromContext(ctx).ErrorContext(ctx, "server did not send a response", "route", path)
 	}
 }
 
-func (instance *Server) runGlobalHandlers(ctx context.Context, path string, w *ResponseWriter, r *http.Request, before bool) error {
+func (instance *Server) runGlobalHandlers(ctx context.Context, table *routeTable, path string, w *ResponseWriter, r *http.Request, before bool) error {
 	// Start tracing
-	_, span := otel.Tracer(traceProviderName).Start(ctx, "runGlobalHandlers")
+	c, span := instance.tracer().Start(ctx, "runGlobalHandlers")
 	defer span.End()
 	// End tracing
 
-	var handlers []GlobalHandler
+	handlers := table.globalHandlerChain(before)
+
+	kind := afterAllHandlerKind
 	if before {
-		handlers = instance.router.globalHandlers.beforeAll
-	} else {
-		handlers = instance.router.globalHandlers.afterAll
+		kind = beforeAllHandlerKind
 	}
-
-	nextCalled := false
 	for _, handler := range handlers {
 		ignored := false
 		if handler.options != nil {
@@ -313,12 +636,11 @@ func (instance *Server) runGlobalHandlers(ctx context.Context, path string, w *R
 				continue
 			}
 		}
-		err := handler.handler(ctx, w, r, func() {
-			nextCalled = true
-		})
+		nextCalled, err := instance.runHandler(c, kind, handler.name, handler.handler, w, r)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Printf("Error: %v", err)
+			instance.currentMetrics().handlerErrors.Add(ctx, 1, metric.WithAttributes(routeAttributes(path, r)...))
+			instance.errorHandler(ctx, w, r, err)
+			LoggerFromContext(ctx).ErrorContext(ctx, "global handler failed", "error", err, "route", path, "handler", handler.name, "kind", kind)
 			return err
 		}
 		if !nextCalled {
@@ -328,6 +650,65 @@ func (instance *Server) runGlobalHandlers(ctx context.Context, path string, w *R
 	return nil
 }
 
+// runHandler runs a single handler in its own child span and reports whether it called next.
+func (instance *Server) runHandler(ctx context.Context, kind string, name string, handler RequestHandler, w *ResponseWriter, r *http.Request) (bool, error) {
+	c, span := instance.tracer().Start(ctx, name, trace.WithAttributes(
+		attribute.String(handlerNameKey, name),
+		attribute.String(handlerKindKey, kind),
+	))
+	// Ending the span records a panic escaping the handler as an exception event, with its stack
+	defer span.End(trace.WithStackTrace(true))
+	defer func() {
+		// runHandlersRecovering turns the panic into a response further up
+		if recovered := recover(); recovered != nil {
+			if recovered != http.ErrAbortHandler {
+				span.SetStatus(codes.Error, fmt.Sprintf("panic: %v", recovered))
+			}
+			panic(recovered)
+		}
+	}()
+
+	nextCalled := false
+	err := handler(c, w, r, func() {
+		nextCalled = true
+	})
+	span.SetAttributes(attribute.Bool(handlerNextCalledKey, nextCalled))
+	if err != nil {
+		recordError(span, err)
+	}
+	return nextCalled, err
+}
+
+// validateTLSConfig checks that the certificate and key files of a non-nil config exist.
+func validateTLSConfig(tls *TLSConfig) error {
+	if tls == nil {
+		return nil
+	}
+	pairs := tls.pairs()
+	if len(pairs) == 0 {
+		return &TLSFileError{Err: errors.New("no certificate and key files")}
+	}
+	for _, pair := range pairs {
+		for _, path := range []string{pair.CertFilePath, pair.KeyFilePath} {
+			if err := validatePath(path); err != nil {
+				return &TLSFileError{Path: path, Err: err}
+			}
+		}
+		for _, name := range pair.ServerNames {
+			if name == "" || strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+				return &TLSFileError{Path: pair.CertFilePath, Err: fmt.Errorf("invalid server name %q", name)}
+			}
+		}
+	}
+	if err := validateClientAuth(tls); err != nil {
+		return err
+	}
+	if tls.Redirect != nil {
+		return validateRedirectConfig(tls.Redirect)
+	}
+	return nil
+}
+
 func validatePath(path string) error {
 	fileInfo, err := os.Stat(path)
 	if err != nil {
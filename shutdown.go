@@ -0,0 +1,68 @@
+package grouter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ShutdownPhase is a step of Shutdown that hooks can run at.
+type ShutdownPhase int
+
+const (
+	// ShutdownDraining starts the drain period, readiness reports unhealthy while requests are still served
+	ShutdownDraining ShutdownPhase = iota
+	// ShutdownGraceful stops accepting connections and waits for in-flight requests up to the shutdown timeout
+	ShutdownGraceful
+	// ShutdownForced closes the connections that are left once the shutdown timeout has passed
+	ShutdownForced
+	// ShutdownStopped follows the last connection being closed
+	ShutdownStopped
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// Ready reports whether the server is serving and not shutting down.
+func (instance *Server) Ready() bool {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	return instance.state == stateServing
+}
+
+// UseReadinessEndpoint serves 200 on path while the server is ready and 503 once it starts draining,
+// so that load balancers stop sending it requests before it stops accepting them.
+func (instance *Server) UseReadinessEndpoint(path string) {
+	instance.Get(path, func(ctx context.Context, w *ResponseWriter, r *http.Request, next func()) error {
+		if !instance.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return nil
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+}
+
+// drain waits for the drain period unless ctx is cancelled first.
+func drain(ctx context.Context, period time.Duration) {
+	if period <= 0 {
+		return
+	}
+	timer := time.NewTimer(period)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// close closes every server of the group, cutting off the connections that are still open.
+func (group *listenerGroup) close() error {
+	var errs []error
+	for _, server := range group.servers {
+		if err := server.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -4,19 +4,146 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
 
 	"github.com/google/uuid"
-	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/sdk/resource"
 	"go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 const traceProviderName = "grouter"
 
+// Attribute keys from the OpenTelemetry HTTP semantic conventions
+const (
+	requestMethodKey      = "http.request.method"
+	requestBodySizeKey    = "http.request.body.size"
+	responseStatusCodeKey = "http.response.status_code"
+	responseBodySizeKey   = "http.response.body.size"
+	routeKey              = "http.route"
+	urlPathKey            = "url.path"
+	urlQueryKey           = "url.query"
+	urlSchemeKey          = "url.scheme"
+	serverAddressKey      = "server.address"
+	serverPortKey         = "server.port"
+	clientAddressKey      = "client.address"
+	clientPortKey         = "client.port"
+	userAgentKey          = "user_agent.original"
+	protocolVersionKey    = "network.protocol.version"
+)
+
+// Attribute keys and values describing individual handlers in a chain
+const (
+	handlerNameKey       = "grouter.handler.name"
+	handlerKindKey       = "grouter.handler.kind"
+	handlerNextCalledKey = "grouter.handler.next_called"
+
+	beforeAllHandlerKind = "global.before_all"
+	routeHandlerKind     = "route"
+	afterAllHandlerKind  = "global.after_all"
+)
+
+// Span events and attributes recording the router's decisions and failures
+const (
+	routeNotFoundEvent         = "grouter.route.not_found"
+	routeMethodNotAllowedEvent = "grouter.route.method_not_allowed"
+	routeRedirectEvent         = "grouter.route.redirect"
+
+	allowedMethodsKey   = "grouter.route.allowed_methods"
+	redirectLocationKey = "http.response.header.location"
+	errorTypeKey        = "error.type"
+	exceptionEscapedKey = "exception.escaped"
+)
+
+// Attribute keys describing the server's lifecycle
+const (
+	interruptedRequestsKey = "grouter.shutdown.interrupted_requests"
+)
+
+// recordError records err on span and marks the span as failed.
+func recordError(span oteltrace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	span.SetAttributes(attribute.String(errorTypeKey, fmt.Sprintf("%T", err)))
+}
+
+// recordPanic records a recovered panic on span together with the stack of the panicking goroutine.
+func recordPanic(span oteltrace.Span, recovered any) {
+	err, ok := recovered.(error)
+	if !ok {
+		err = fmt.Errorf("%v", recovered)
+	}
+	span.RecordError(err, oteltrace.WithStackTrace(true), oteltrace.WithAttributes(attribute.Bool(exceptionEscapedKey, true)))
+	span.SetStatus(codes.Error, fmt.Sprintf("panic: %v", recovered))
+	span.SetAttributes(attribute.String(errorTypeKey, fmt.Sprintf("%T", recovered)))
+}
+
+// requestAttributes returns the semantic convention attributes known when a request for route arrives.
+func requestAttributes(route string, r *http.Request) []attribute.KeyValue {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	attributes := []attribute.KeyValue{
+		attribute.String(requestMethodKey, r.Method),
+		attribute.Int(requestBodySizeKey, int(r.ContentLength)),
+		attribute.String(urlPathKey, r.URL.Path),
+		attribute.String(urlSchemeKey, scheme),
+		attribute.String(protocolVersionKey, protocolVersion(r)),
+	}
+	// Unmatched requests have no route template
+	if route != "" {
+		attributes = append(attributes, attribute.String(routeKey, route))
+	}
+	if r.URL.RawQuery != "" {
+		attributes = append(attributes, attribute.String(urlQueryKey, r.URL.RawQuery))
+	}
+	if host, port := splitHostPort(r.Host); host != "" {
+		attributes = append(attributes, attribute.String(serverAddressKey, host))
+		if port > 0 {
+			attributes = append(attributes, attribute.Int(serverPortKey, port))
+		}
+	}
+	if host, port := splitHostPort(r.RemoteAddr); host != "" {
+		attributes = append(attributes, attribute.String(clientAddressKey, host))
+		if port > 0 {
+			attributes = append(attributes, attribute.Int(clientPortKey, port))
+		}
+	}
+	if userAgent := r.UserAgent(); userAgent != "" {
+		attributes = append(attributes, attribute.String(userAgentKey, userAgent))
+	}
+	return attributes
+}
+
+// protocolVersion formats the HTTP version the way the semantic conventions expect, e.g. "1.1" or "2".
+func protocolVersion(r *http.Request) string {
+	if r.ProtoMinor == 0 && r.ProtoMajor > 1 {
+		return strconv.Itoa(r.ProtoMajor)
+	}
+	return fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)
+}
+
+// splitHostPort splits an address into host and port, returning a zero port when there is none.
+func splitHostPort(address string) (string, int) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return address, 0
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return host, 0
+	}
+	return host, port
+}
+
 // newExporter returns a console exporter.
 func newExporter(w io.Writer) (trace.SpanExporter, error) {
 	return stdouttrace.New(
@@ -28,47 +155,95 @@ func newExporter(w io.Writer) (trace.SpanExporter, error) {
 	)
 }
 
+// ResourceConfig describes the service that emits the traces.
+// Empty fields fall back to OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES,
+// and then to grouter's defaults.
+type ResourceConfig struct {
+	ServiceName    string
+	ServiceVersion string
+	Environment    string
+	Attributes     map[string]string
+}
+
+const (
+	defaultServiceName    = "grouter trace provider"
+	defaultServiceVersion = "v0.1.0"
+	defaultEnvironment    = "development"
+	environmentKey        = attribute.Key("environment")
+)
+
 // newResource returns a resource describing this application.
-func newResource() *resource.Resource {
-	// TODO: inject version
-	r, _ := resource.Merge(
+// Precedence is config, then the OTEL_* environment variables, then the defaults.
+func newResource(config *ResourceConfig) (*resource.Resource, error) {
+	r, err := resource.Merge(
 		resource.Default(),
 		resource.NewWithAttributes(
 			semconv.SchemaURL,
-			semconv.ServiceName("grouter trace provider"),
-			semconv.ServiceVersion("v0.1.0"),
-			attribute.String("environment", "development"),
+			semconv.ServiceName(defaultServiceName),
+			semconv.ServiceVersion(defaultServiceVersion),
+			environmentKey.String(defaultEnvironment),
 		),
 	)
-	return r
+	if err != nil {
+		return nil, err
+	}
+	r, err = resource.Merge(r, resource.Environment())
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return r, nil
+	}
+
+	attributes := []attribute.KeyValue{}
+	for key, value := range config.Attributes {
+		attributes = append(attributes, attribute.String(key, value))
+	}
+	// The dedicated fields win over the same keys in Attributes
+	if config.ServiceName != "" {
+		attributes = append(attributes, semconv.ServiceName(config.ServiceName))
+	}
+	if config.ServiceVersion != "" {
+		attributes = append(attributes, semconv.ServiceVersion(config.ServiceVersion))
+	}
+	if config.Environment != "" {
+		attributes = append(attributes, environmentKey.String(config.Environment))
+	}
+	return resource.Merge(r, resource.NewWithAttributes(semconv.SchemaURL, attributes...))
 }
 
-func startTracing() (func(context.Context) error, error) {
+// startTracing returns a tracer provider writing to a new file of grouter's default trace directory.
+// The provider is not set as otel's global one, other instances and the host process keep their own.
+func startTracing(config *ResourceConfig) (*trace.TracerProvider, func(context.Context) error, error) {
 	var err error
 	var id uuid.UUID
 
+	res, err := newResource(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	if _, err = os.Stat("traces"); os.IsNotExist(err) {
 		err = os.Mkdir("traces", 0755)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
 	id, err = uuid.NewRandom()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	f, err := os.Create(fmt.Sprintf("traces/%s.trace", id.String()))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	exp, err := newExporter(io.Writer(f))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	tp := trace.NewTracerProvider(trace.WithBatcher(exp), trace.WithResource(newResource()))
-	otel.SetTracerProvider(tp)
+	tp := trace.NewTracerProvider(trace.WithBatcher(exp), trace.WithResource(res))
 
 	shutdown := func(ctx context.Context) error {
 		var err error
@@ -84,5 +259,5 @@ func startTracing() (func(context.Context) error, error) {
 		}
 		return err
 	}
-	return shutdown, nil
+	return tp, shutdown, nil
 }
@@ -0,0 +1,40 @@
+package grouter
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// ListenUnix serves on a Unix domain socket at path, e.g. behind a reverse proxy on the same host.
+// A socket file left behind by a server that is no longer running is removed first.
+// A non-zero mode sets the socket's permissions, observer is closed once the socket is bound,
+// or when ListenUnix fails before serving.
+// The socket file is removed when the server shuts down.
+func (instance *Server) ListenUnix(path string, mode os.FileMode, observer chan struct{}) error {
+	return instance.serveAll([]Endpoint{{Network: "unix", Address: path, Mode: mode}}, false, nil, observer)
+}
+
+// removeStaleSocket removes the socket at path unless a server still accepts connections on it.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return &SocketError{Path: path, Err: errors.New("file exists and is not a socket")}
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return &SocketError{Path: path, Err: ErrSocketInUse}
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return &SocketError{Path: path, Err: err}
+	}
+	return os.Remove(path)
+}